@@ -4,6 +4,7 @@
 package fakemachine
 
 import (
+	"context"
 	"fmt"
 )
 
@@ -102,15 +103,31 @@ type backend interface {
 	// The tty used for the job output
 	JobOutputTTY() string
 
+	// The devices used for the job input, output and error streams when
+	// these are redirected by the caller
+	JobStreamDevices() (stdin, stdout, stderr string)
+
+	// The device used to talk to the session agent, see Machine.Start()
+	AgentDevice() string
+
 	// The parameters used to mount a specific volume into the machine
 	MountParameters(mount mountPoint) (fstype string, options []string)
 
+	// The kernel command line arguments the machine needs to work, which
+	// can't be overridden by the user
+	KernelArgs() []string
+
 	// A list of modules to be added to initrd and probed in the initscript
 	InitModules() []string
 
 	// A list of additional volumes which should mounted in the initscript
 	InitStaticVolumes() []mountPoint
 
-	// Start an instance of the backend
-	Start() (bool, error)
+	// Whether the kernel of the last started instance panicked, as far as the
+	// backend can tell
+	KernelPanicked() (bool, error)
+
+	// Start an instance of the backend, the instance is terminated if ctx is
+	// cancelled before it exits on its own
+	Start(ctx context.Context) (bool, error)
 }
@@ -1,15 +1,21 @@
-//go:build linux && (arm64 || amd64)
+//go:build linux && (arm64 || amd64 || riscv64 || arm || 386 || ppc64le)
 
 package fakemachine
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -40,6 +46,9 @@ type qemuMachine struct {
 	machine string
 	/* Cpu to use for qemu backend if the architecture doesn't have a good default */
 	qemuCPU string
+	/* The virtio console used for the job output, if the machine's own
+	 * console already takes /dev/hvc0 */
+	jobTTY string
 }
 
 var qemuMachines = map[Arch]qemuMachine{
@@ -59,6 +68,29 @@ var qemuMachines = map[Arch]qemuMachine{
 		 * a specific small cortex-a processor instead */
 		qemuCPU: "cortex-a53",
 	},
+	Armhf: {
+		binary:  "qemu-system-arm",
+		console: "ttyAMA0",
+		machine: "virt",
+	},
+	I386: {
+		binary:  "qemu-system-i386",
+		console: "ttyS0",
+		machine: "pc",
+	},
+	Ppc64el: {
+		binary: "qemu-system-ppc64",
+		/* The pseries console is a hypervisor virtual terminal, which
+		 * makes the virtio console the second hvc device */
+		console: "hvc0",
+		machine: "pseries",
+		jobTTY:  "/dev/hvc1",
+	},
+	Riscv64: {
+		binary:  "qemu-system-riscv64",
+		console: "ttyS0",
+		machine: "virt",
+	},
 }
 
 func (b qemuBackend) QemuPath() (string, error) {
@@ -75,6 +107,27 @@ func (b qemuBackend) QemuPath() (string, error) {
 }
 
 func (b qemuBackend) KernelRelease() (string, error) {
+	/* A module directory set by the user is named after its release, a
+	 * kernel set by the user determines the release if possible */
+	if b.machine.moduleDir != "" {
+		return path.Base(b.machine.moduleDir), nil
+	}
+	if b.machine.kernelPath != "" {
+		release, err := kernelImageRelease(b.machine.kernelPath)
+		if err != nil {
+			return "", err
+		}
+		if release != "" {
+			return release, nil
+		}
+	}
+
+	/* The running kernel is of no use for a machine based on a sysroot, so
+	 * always take the latest kernel from its modules directory */
+	if b.machine.sysroot != "" {
+		return latestKernelRelease(b.machine.rootPath("/lib/modules"))
+	}
+
 	/* First try the kernel the current system is running, but if there are no
 	 * modules for that try the latest from /lib/modules. The former works best
 	 * for systems directly running fakemachine, the latter makes sense in docker
@@ -97,9 +150,15 @@ func (b qemuBackend) KernelRelease() (string, error) {
 		return "", fmt.Errorf("checking module directory %s: %w", moduleDir, err)
 	}
 
-	files, err := os.ReadDir("/lib/modules")
+	return latestKernelRelease("/lib/modules")
+}
+
+// latestKernelRelease returns the latest kernel release with a module
+// directory in moddir
+func latestKernelRelease(moddir string) (string, error) {
+	files, err := os.ReadDir(moddir)
 	if err != nil {
-		return "", fmt.Errorf("listing /lib/modules: %w", err)
+		return "", fmt.Errorf("listing %s: %w", moddir, err)
 	}
 
 	for i := len(files) - 1; i >= 0; i-- {
@@ -115,6 +174,13 @@ func (b qemuBackend) KernelRelease() (string, error) {
 }
 
 func (b qemuBackend) KernelPath() (string, error) {
+	if b.machine.kernelPath != "" {
+		if _, err := os.Stat(b.machine.kernelPath); err != nil {
+			return "", fmt.Errorf("failed to stat kernel path %s: %w", b.machine.kernelPath, err)
+		}
+		return b.machine.kernelPath, nil
+	}
+
 	/* First we look within the modules directory, as supported by
 	 * various distributions - Arch, Fedora...
 	 *
@@ -142,19 +208,33 @@ func (b qemuBackend) KernelPath() (string, error) {
 		return "", err
 	}
 
-	kernelPath := path.Join("/boot", "vmlinuz-"+kernelRelease)
-	if _, err := os.Stat(kernelPath); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return "", fmt.Errorf("kernel not found at %s", kernelPath)
+	/* Architectures without compressed kernel images, like ppc64el, install
+	 * them as vmlinux */
+	var kernelPaths []string
+	for _, name := range []string{"vmlinuz-", "vmlinux-"} {
+		kernelPath := b.machine.rootPath(path.Join("/boot", name+kernelRelease))
+		if _, err := os.Stat(kernelPath); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return "", fmt.Errorf("failed to stat kernel path %s: %w", kernelPath, err)
+			}
+			kernelPaths = append(kernelPaths, kernelPath)
+			continue
 		}
 
-		return "", fmt.Errorf("failed to stat kernel path %s: %w", kernelPath, err)
+		return kernelPath, nil
 	}
 
-	return kernelPath, nil
+	return "", fmt.Errorf("kernel not found at %s", strings.Join(kernelPaths, " or "))
 }
 
 func (b qemuBackend) ModulePath() (string, error) {
+	if b.machine.moduleDir != "" {
+		if _, err := os.Stat(b.machine.moduleDir); err != nil {
+			return "", fmt.Errorf("stat %s: %w", b.machine.moduleDir, err)
+		}
+		return b.machine.moduleDir, nil
+	}
+
 	kernelRelease, err := b.KernelRelease()
 	if err != nil {
 		return "", err
@@ -165,7 +245,7 @@ func (b qemuBackend) ModulePath() (string, error) {
 		moddir = "/usr/lib/modules"
 	}
 
-	moddir = path.Join(moddir, kernelRelease)
+	moddir = b.machine.rootPath(path.Join(moddir, kernelRelease))
 	if _, err := os.Stat(moddir); err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return "", fmt.Errorf("module directory not found at %s: %w", moddir, err)
@@ -199,26 +279,338 @@ func (b qemuBackend) JobOutputTTY() string {
 	if b.machine.showBoot {
 		return "/dev/console"
 	}
+	if tty := qemuMachines[b.machine.arch].jobTTY; tty != "" {
+		return tty
+	}
 	return "/dev/hvc0"
 }
 
-func (b qemuBackend) MountParameters(_ mountPoint) (string, []string) {
-	return "9p", []string{"trans=virtio", "version=9p2000.L", "cache=loose", "msize=262144"}
+func (b qemuBackend) JobStreamDevices() (string, string, string) {
+	// Each redirected stream gets its own virtio serial port, see
+	// qemuStreams
+	return "/dev/virtio-ports/fakemachine.stdin",
+		"/dev/virtio-ports/fakemachine.stdout",
+		"/dev/virtio-ports/fakemachine.stderr"
+}
+
+func (b qemuBackend) AgentDevice() string {
+	return "/dev/virtio-ports/fakemachine.agent"
+}
+
+func (b qemuBackend) MountParameters(mount mountPoint) (string, []string) {
+	fstype := "virtiofs"
+	options := []string{}
+	if b.machine.virtiofsd == "" {
+		cache := mount.options.Cache
+		if cache == "" {
+			cache = "loose"
+		}
+		msize := mount.options.Msize
+		if msize == 0 {
+			msize = 262144
+		}
+
+		fstype = "9p"
+		options = append(options, "trans=virtio", "version=9p2000.L",
+			fmt.Sprintf("cache=%s", cache), fmt.Sprintf("msize=%d", msize))
+		if mount.options.Access != "" {
+			options = append(options, fmt.Sprintf("access=%s", mount.options.Access))
+		}
+	}
+
+	if mount.options.ReadOnly {
+		options = append(options, "ro")
+	}
+	return fstype, options
+}
+
+func (b qemuBackend) KernelArgs() []string {
+	console := fmt.Sprintf("console=%s", qemuMachines[b.machine.arch].console)
+	return []string{console, "panic=-1",
+		"plymouth.enable=0",
+		"systemd.unit=fakemachine.service"}
+}
+
+// consoleLogPath is the file the machine console is logged to unless it's
+// shown to the user
+func (b qemuBackend) consoleLogPath() string {
+	return path.Join(path.Dir(b.machine.initrdpath), "console.log")
+}
+
+func (b qemuBackend) KernelPanicked() (bool, error) {
+	// The console is only logged if it isn't shown
+	if b.machine.showBoot {
+		return false, nil
+	}
+
+	console, err := os.ReadFile(b.consoleLogPath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read console log: %w", err)
+	}
+
+	return bytes.Contains(console, []byte("Kernel panic - not syncing")), nil
 }
 
 func (b qemuBackend) InitModules() []string {
-	return []string{"virtio_pci", "virtio_console", "9pnet_virtio", "9p"}
+	modules := []string{"virtio_pci", "virtio_console", "9pnet_virtio", "9p"}
+	if b.machine.virtiofsd != "" {
+		modules = append(modules, "virtiofs")
+	}
+	return modules
 }
 
 func (b qemuBackend) InitStaticVolumes() []mountPoint {
 	return []mountPoint{}
 }
 
-func (b qemuBackend) Start() (bool, error) {
-	return b.StartQemu(false)
+func (b qemuBackend) Start(ctx context.Context) (bool, error) {
+	return b.StartQemu(ctx, false)
 }
 
-func (b qemuBackend) StartQemu(kvm bool) (bool, error) {
+// Time given to qemu to exit after being asked to terminate before it gets
+// killed
+const qemuTerminateTimeout = 10 * time.Second
+
+// qemuStreams connects the redirected standard streams of the machine to the
+// callers reader and writers. Every stream is exposed to the machine as a
+// named virtio serial port, backed by a unix socket which qemu connects to on
+// startup.
+type qemuStreams struct {
+	listeners []*net.UnixListener
+	wg        sync.WaitGroup
+	mu        sync.Mutex
+	err       error
+}
+
+func (s *qemuStreams) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = errors.Join(s.err, err)
+}
+
+// listen creates the socket for the named stream and returns the qemu
+// arguments to connect it to a virtio serial port
+func (s *qemuStreams) listen(dir, name string) (*net.UnixListener, []string, error) {
+	socket := path.Join(dir, name+".sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to listen on %s: %w", socket, err)
+	}
+	s.listeners = append(s.listeners, l)
+
+	return l, []string{
+		"-chardev", fmt.Sprintf("socket,id=for-%s,path=%s", name, socket),
+		"-device", fmt.Sprintf("virtserialport,chardev=for-%s,name=fakemachine.%s", name, name),
+	}, nil
+}
+
+// input copies r into the stream once qemu has connected. The stream isn't
+// waited for as reading r may block indefinitely.
+func (s *qemuStreams) input(l *net.UnixListener, r io.Reader) {
+	go func() {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		// Signal end of file to the machine once r is exhausted
+		if _, err := io.Copy(conn, r); err == nil {
+			_ = conn.CloseWrite()
+		}
+	}()
+}
+
+// output copies everything written to the stream by the machine to w
+func (s *qemuStreams) output(l *net.UnixListener, w io.Writer) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+
+		if _, err := io.Copy(w, conn); err != nil {
+			s.setErr(fmt.Errorf("failed to copy machine output: %w", err))
+		}
+	}()
+}
+
+// wait closes the sockets and waits for all output to be copied, it should
+// only be called once qemu has exited.
+func (s *qemuStreams) wait() error {
+	for _, l := range s.listeners {
+		_ = l.Close()
+	}
+	s.wg.Wait()
+
+	return s.err
+}
+
+// setupStreams creates the sockets for the redirected streams in dir and
+// returns the qemu arguments to expose them to the machine
+func (b qemuBackend) setupStreams(dir string) (*qemuStreams, []string, error) {
+	m := b.machine
+	s := &qemuStreams{}
+	var args []string
+
+	if m.stdin != nil {
+		l, streamArgs, err := s.listen(dir, "stdin")
+		if err != nil {
+			return nil, nil, err
+		}
+		args = append(args, streamArgs...)
+		s.input(l, m.stdin)
+	}
+
+	outputs := []struct {
+		name string
+		w    io.Writer
+		def  io.Writer
+	}{
+		{"stdout", m.stdout, os.Stdout},
+		{"stderr", m.stderr, os.Stderr},
+	}
+	for _, o := range outputs {
+		l, streamArgs, err := s.listen(dir, o.name)
+		if err != nil {
+			return nil, nil, errors.Join(err, s.wait())
+		}
+		args = append(args, streamArgs...)
+
+		w := o.w
+		if w == nil {
+			w = o.def
+		}
+		s.output(l, w)
+	}
+
+	return s, args, nil
+}
+
+// findVirtiofsd looks for the virtiofsd binary on the host, it isn't usually
+// installed in $PATH
+func findVirtiofsd() (string, error) {
+	if path, err := exec.LookPath("virtiofsd"); err == nil {
+		return path, nil
+	}
+
+	path := "/usr/libexec/virtiofsd"
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("failed to find virtiofsd: %w", err)
+	}
+	return path, nil
+}
+
+// virtiofsDaemons are the virtiofsd processes serving the volumes of the
+// machine, one per volume
+type virtiofsDaemons struct {
+	cmds []*exec.Cmd
+}
+
+// start runs virtiofsd for the volume on a socket in dir and returns the
+// qemu arguments to expose it to the machine. The listening socket is handed
+// to virtiofsd so qemu can connect to it straight away.
+func (d *virtiofsDaemons) start(virtiofsd, dir string, point mountPoint, output io.Writer) ([]string, error) {
+	socket := path.Join(dir, point.label+".sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", socket, err)
+	}
+	l.SetUnlinkOnClose(false)
+	defer func() {
+		_ = l.Close()
+	}()
+
+	f, err := l.File()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file of %s: %w", socket, err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	// The sandbox needs privileges fakemachine usually runs without, it is
+	// no more needed than for 9p where qemu accesses the files directly
+	args := []string{
+		"--fd=3",
+		"--shared-dir", point.hostDirectory,
+		"--cache=auto",
+		"--sandbox=none",
+	}
+	if point.options.ReadOnly {
+		args = append(args, "--readonly")
+	}
+
+	cmd := exec.Command(virtiofsd, args...)
+	cmd.ExtraFiles = []*os.File{f}
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start virtiofsd for %s: %w", point.hostDirectory, err)
+	}
+	d.cmds = append(d.cmds, cmd)
+
+	return []string{
+		"-chardev", fmt.Sprintf("socket,id=for-%s,path=%s", point.label, socket),
+		"-device", fmt.Sprintf("vhost-user-fs-pci,chardev=for-%s,tag=%s", point.label, point.label),
+	}, nil
+}
+
+// stop terminates the daemons, it should only be called once qemu has exited
+func (d *virtiofsDaemons) stop() error {
+	var errs error
+	for _, cmd := range d.cmds {
+		if err := cmd.Process.Signal(unix.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+			errs = errors.Join(errs, fmt.Errorf("failed to terminate virtiofsd: %w", err))
+		}
+		// virtiofsd exits on its own once qemu has gone, so the exit
+		// status isn't interesting
+		_ = cmd.Wait()
+	}
+	return errs
+}
+
+// setupVirtiofs starts virtiofsd for every volume, creating their sockets in
+// dir, and returns the qemu arguments to expose them to the machine
+func (b qemuBackend) setupVirtiofs(dir string) (*virtiofsDaemons, []string, error) {
+	m := b.machine
+	d := &virtiofsDaemons{}
+
+	// vhost-user devices need the memory of the machine to be shared with
+	// the daemons
+	args := []string{
+		"-object", fmt.Sprintf("memory-backend-memfd,id=mem,size=%dM,share=on", m.memory),
+		"-numa", "node,memdev=mem",
+	}
+
+	var output io.Writer
+	if m.showBoot {
+		output = os.Stderr
+	}
+
+	for _, point := range m.mounts {
+		daemonArgs, err := d.start(m.virtiofsd, dir, point, output)
+		if err != nil {
+			return nil, nil, errors.Join(err, d.stop())
+		}
+		args = append(args, daemonArgs...)
+	}
+
+	return d, args, nil
+}
+
+func (b qemuBackend) StartQemu(ctx context.Context, kvm bool) (_ bool, err error) {
 	m := b.machine
 	qemuMachine := qemuMachines[m.arch]
 
@@ -234,9 +626,19 @@ func (b qemuBackend) StartQemu(kvm bool) (bool, error) {
 		"-kernel", kernelPath,
 		"-initrd", m.initrdpath,
 		"-display", "none",
-		"-nic", "user,model=virtio-net-pci",
 		"-no-reboot"}
 
+	switch m.network {
+	case NetworkNone:
+		qemuargs = append(qemuargs, "-nic", "none")
+	default:
+		nic := "user,model=virtio-net-pci"
+		for _, f := range m.forwards {
+			nic += fmt.Sprintf(",hostfwd=%s:%s:%d-:%d", f.proto, f.hostAddr, f.hostPort, f.guestPort)
+		}
+		qemuargs = append(qemuargs, "-nic", nic)
+	}
+
 	if kvm {
 		qemuargs = append(qemuargs,
 			"-cpu", "host",
@@ -246,10 +648,7 @@ func (b qemuBackend) StartQemu(kvm bool) (bool, error) {
 	}
 
 	qemuargs = append(qemuargs, "-machine", qemuMachine.machine)
-	console := fmt.Sprintf("console=%s", qemuMachine.console)
-	kernelargs := []string{console, "panic=-1",
-		"plymouth.enable=0",
-		"systemd.unit=fakemachine.service"}
+	kernelargs := b.KernelArgs()
 
 	if m.showBoot {
 		// Create a character device representing our stdio
@@ -261,25 +660,54 @@ func (b qemuBackend) StartQemu(kvm bool) (bool, error) {
 			"-chardev", "stdio,id=for-ttyS0,signal=off",
 			"-serial", "chardev:for-ttyS0")
 		kernelargs = append(kernelargs, "loglevel=7")
+		if m.redirectStreams() || m.agentSocket != "" {
+			// Create the bus for the virtio serial ports of
+			// the redirected streams and the session agent
+			qemuargs = append(qemuargs, "-device", "virtio-serial")
+		}
 	} else {
+		// Connect the fakemachine script to our stdio file
+		// descriptors, unless its streams are redirected in which
+		// case the console isn't used for anything
+		hvc0 := "stdio,id=for-hvc0,signal=off"
+		if m.redirectStreams() {
+			hvc0 = "null,id=for-hvc0"
+		}
 		qemuargs = append(qemuargs,
 			// Create the bus for virtio consoles
 			"-device", "virtio-serial",
 			// Create /dev/ttyS0 to be the VM console, but
-			// ignore anything written to it, so that it
-			// doesn't corrupt our terminal
-			"-chardev", "null,id=for-ttyS0",
+			// log anything written to it to a file rather
+			// than our terminal, so that it doesn't corrupt
+			// it
+			"-chardev", fmt.Sprintf("file,id=for-ttyS0,path=%s", b.consoleLogPath()),
 			"-serial", "chardev:for-ttyS0",
-			// Connect the fakemachine script to our stdio
-			// file descriptors
-			"-chardev", "stdio,id=for-hvc0,signal=off",
+			"-chardev", hvc0,
 			"-device", "virtconsole,chardev=for-hvc0")
 	}
 
-	for _, point := range m.mounts {
-		qemuargs = append(qemuargs, "-virtfs",
-			fmt.Sprintf("local,mount_tag=%s,path=%s,security_model=none,multidevs=remap",
-				point.label, point.hostDirectory))
+	var daemons *virtiofsDaemons
+	if m.virtiofsd != "" {
+		var virtiofsArgs []string
+		daemons, virtiofsArgs, err = b.setupVirtiofs(path.Dir(m.initrdpath))
+		if err != nil {
+			return false, err
+		}
+		defer func() {
+			if stopErr := daemons.stop(); stopErr != nil {
+				err = errors.Join(err, stopErr)
+			}
+		}()
+		qemuargs = append(qemuargs, virtiofsArgs...)
+	} else {
+		for _, point := range m.mounts {
+			virtfs := fmt.Sprintf("local,mount_tag=%s,path=%s,security_model=none,multidevs=remap",
+				point.label, point.hostDirectory)
+			if point.options.ReadOnly {
+				virtfs += ",readonly=on"
+			}
+			qemuargs = append(qemuargs, "-virtfs", virtfs)
+		}
 	}
 
 	for i, img := range m.images {
@@ -290,6 +718,7 @@ func (b qemuBackend) StartQemu(kvm bool) (bool, error) {
 				i, i, img.label, m.sectorSize, m.sectorSize))
 	}
 
+	kernelargs = append(kernelargs, m.kernelArgs...)
 	qemuargs = append(qemuargs, "-append", strings.Join(kernelargs, " "))
 
 	pa := os.ProcAttr{
@@ -301,17 +730,65 @@ func (b qemuBackend) StartQemu(kvm bool) (bool, error) {
 		return false, err
 	}
 
+	var streams *qemuStreams
+	if m.redirectStreams() {
+		var streamArgs []string
+		streams, streamArgs, err = b.setupStreams(path.Dir(m.initrdpath))
+		if err != nil {
+			return false, err
+		}
+		qemuargs = append(qemuargs, streamArgs...)
+	}
+
+	// Connect the session agent port to the socket the session listens on
+	if m.agentSocket != "" {
+		qemuargs = append(qemuargs,
+			"-chardev", fmt.Sprintf("socket,id=for-agent,path=%s", m.agentSocket),
+			"-device", "virtserialport,chardev=for-agent,name=fakemachine.agent")
+	}
+
 	p, err := os.StartProcess(qemubin, qemuargs, &pa)
 	if err != nil {
+		if streams != nil {
+			err = errors.Join(err, streams.wait())
+		}
 		return false, fmt.Errorf("failed to start qemu process: %w", err)
 	}
 
+	// terminate qemu if the context gets cancelled before it exits. qemu
+	// shuts down cleanly on SIGTERM (restoring the terminal state); only kill
+	// it if it doesn't manage to do so in time.
+	exited := make(chan struct{})
+	defer close(exited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = p.Signal(unix.SIGTERM)
+			select {
+			case <-time.After(qemuTerminateTimeout):
+				_ = p.Kill()
+			case <-exited:
+			}
+		case <-exited:
+		}
+	}()
+
 	// wait for kvm process to exit
 	pstate, err := p.Wait()
 	if err != nil {
 		return false, fmt.Errorf("error waiting for qemu process: %w", err)
 	}
 
+	if streams != nil {
+		if err := streams.wait(); err != nil {
+			return false, err
+		}
+	}
+
+	if ctx.Err() != nil {
+		return false, fmt.Errorf("qemu process terminated: %w", ctx.Err())
+	}
+
 	return pstate.Success(), nil
 }
 
@@ -328,6 +805,10 @@ func (b kvmBackend) Name() string {
 }
 
 func (b kvmBackend) Supported() (bool, error) {
+	if b.machine != nil && b.machine.arch != archMap[runtime.GOARCH] {
+		return false, fmt.Errorf("kvm can't run %s machines on a %s host", b.machine.arch, runtime.GOARCH)
+	}
+
 	kvmDevice, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
 	if err != nil {
 		return false, fmt.Errorf("failed to open /dev/kvm: %w", err)
@@ -339,6 +820,6 @@ func (b kvmBackend) Supported() (bool, error) {
 	return b.qemuBackend.Supported()
 }
 
-func (b kvmBackend) Start() (bool, error) {
-	return b.StartQemu(true)
+func (b kvmBackend) Start(ctx context.Context) (bool, error) {
+	return b.StartQemu(ctx, true)
 }
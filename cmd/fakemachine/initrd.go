@@ -0,0 +1,255 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	writerhelper "github.com/go-debos/fakemachine/cpio"
+	"github.com/jessevdk/go-flags"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type InitrdListCommand struct {
+	Long bool `short:"l" long:"long" description:"Show the type, permissions and size of the entries"`
+	Args struct {
+		Initrd string `positional-arg-name:"INITRD" description:"Initramfs to list"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+type InitrdExtractCommand struct {
+	Args struct {
+		Initrd    string `positional-arg-name:"INITRD" description:"Initramfs to extract"`
+		Directory string `positional-arg-name:"DIRECTORY" description:"Directory to extract the initramfs into"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// readInitrd calls fn for each entry of the initramfs file, with r positioned
+// at the content of the entry
+func readInitrd(file string, fn func(entry *writerhelper.Entry, r io.Reader) error) (err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("failed to open initramfs: %w", err)
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close initramfs: %w", closeErr))
+		}
+	}()
+
+	r := writerhelper.NewReader(f)
+	defer func() {
+		if closeErr := r.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close initramfs reader: %w", closeErr))
+		}
+	}()
+
+	for {
+		entry, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+
+		if err := fn(entry, r); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *InitrdListCommand) Execute(args []string) error {
+	return readInitrd(c.Args.Initrd, func(entry *writerhelper.Entry, r io.Reader) error {
+		if !c.Long {
+			fmt.Println(entry.Name)
+			return nil
+		}
+
+		description := entry.Name
+		switch mode := entry.FileMode(); {
+		case mode&os.ModeSymlink != 0:
+			target, err := io.ReadAll(r)
+			if err != nil {
+				return fmt.Errorf("failed to read symlink %s: %w", entry.Name, err)
+			}
+			description += " -> " + string(target)
+		case mode&os.ModeDevice != 0:
+			description += fmt.Sprintf(" (%d, %d)", entry.Devmajor, entry.Devminor)
+		case entry.Hardlink != "":
+			description += " link to " + entry.Hardlink
+		}
+
+		fmt.Printf("%s %10d %s\n", entry.FileMode(), entry.Size, description)
+		return nil
+	})
+}
+
+// extractPath returns the location to extract the entry name to within dir,
+// making sure it can't escape dir through relative components or symlinks
+// extracted earlier
+func extractPath(dir, name string) (string, error) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return dir, nil
+	}
+
+	p := dir
+	components := strings.Split(name, "/")
+	for _, c := range components[:len(components)-1] {
+		p = filepath.Join(p, c)
+		info, err := os.Lstat(p)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is below the symlink %s", name, p)
+		}
+	}
+	return filepath.Join(p, components[len(components)-1]), nil
+}
+
+func extractEntry(dir string, entry *writerhelper.Entry, r io.Reader) (err error) {
+	target, err := extractPath(dir, entry.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to create parent of %s: %w", entry.Name, err)
+	}
+
+	mode := entry.FileMode()
+	perm := mode & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+
+	// Never reuse what is already there, except for directories, as anything
+	// else could redirect the extraction out of dir
+	existing, err := os.Lstat(target)
+	if err == nil && !(mode.IsDir() && existing.IsDir()) {
+		return fmt.Errorf("%s already exists", entry.Name)
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to check %s: %w", entry.Name, err)
+	}
+
+	switch {
+	case mode.IsDir():
+		if existing == nil {
+			if err := os.Mkdir(target, 0755); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", entry.Name, err)
+			}
+		}
+		if err := os.Chmod(target, perm); err != nil {
+			return fmt.Errorf("failed to set permissions of %s: %w", entry.Name, err)
+		}
+		return nil
+
+	case mode&os.ModeSymlink != 0:
+		link, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("failed to read symlink %s: %w", entry.Name, err)
+		}
+		if err := os.Symlink(string(link), target); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %w", entry.Name, err)
+		}
+		return nil
+
+	case mode&os.ModeNamedPipe != 0:
+		if err := unix.Mkfifo(target, uint32(perm.Perm())); err != nil {
+			return fmt.Errorf("failed to create fifo %s: %w", entry.Name, err)
+		}
+		return nil
+
+	case mode&os.ModeDevice != 0:
+		devtype := uint32(unix.S_IFBLK)
+		if mode&os.ModeCharDevice != 0 {
+			devtype = unix.S_IFCHR
+		}
+		dev := unix.Mkdev(uint32(entry.Devmajor), uint32(entry.Devminor))
+		err := unix.Mknod(target, devtype|uint32(perm.Perm()), int(dev))
+		if errors.Is(err, unix.EPERM) {
+			fmt.Fprintf(os.Stderr, "fakemachine: Not creating device %s: %v\n", entry.Name, err)
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to create device %s: %w", entry.Name, err)
+		}
+		return nil
+
+	case !mode.IsRegular():
+		fmt.Fprintf(os.Stderr, "fakemachine: Not extracting %s of type %s\n", entry.Name, mode.Type())
+		return nil
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC | os.O_EXCL | unix.O_NOFOLLOW
+	if entry.Hardlink != "" {
+		// The content of hardlinked files may be stored with any of its links
+		source, err := extractPath(dir, entry.Hardlink)
+		if err != nil {
+			return err
+		}
+		info, err := os.Lstat(source)
+		if err != nil {
+			return fmt.Errorf("failed to check hardlink source of %s: %w", entry.Name, err)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is a hardlink to %s, which isn't a regular file", entry.Name, entry.Hardlink)
+		}
+		if err := os.Link(source, target); err != nil {
+			return fmt.Errorf("failed to create hardlink %s: %w", entry.Name, err)
+		}
+		if entry.Size == 0 {
+			return nil
+		}
+		flags = os.O_WRONLY | unix.O_NOFOLLOW
+	}
+
+	f, err := os.OpenFile(target, flags, perm)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", entry.Name, err)
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close %s: %w", entry.Name, closeErr))
+		}
+	}()
+
+	if _, err := io.Copy(f, r); err != nil {
+		return fmt.Errorf("failed to extract %s: %w", entry.Name, err)
+	}
+	// Permissions passed to OpenFile are subject to the umask
+	if err := f.Chmod(perm); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", entry.Name, err)
+	}
+	return nil
+}
+
+func (c *InitrdExtractCommand) Execute(args []string) error {
+	if err := os.MkdirAll(c.Args.Directory, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", c.Args.Directory, err)
+	}
+
+	return readInitrd(c.Args.Initrd, func(entry *writerhelper.Entry, r io.Reader) error {
+		return extractEntry(c.Args.Directory, entry, r)
+	})
+}
+
+// initrdMain implements --inspect-initrd for inspecting an initramfs generated
+// by fakemachine, or any other one
+func initrdMain(args []string) int {
+	parser := flags.NewNamedParser("fakemachine --inspect-initrd", flags.Default)
+	_, err := parser.AddCommand("list", "List the contents of an initramfs", "", &InitrdListCommand{})
+	if err == nil {
+		_, err = parser.AddCommand("extract", "Extract an initramfs into a directory", "", &InitrdExtractCommand{})
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "fakemachine: %v\n", err)
+		return 1
+	}
+
+	// Errors are printed by the parser
+	if _, err := parser.ParseArgs(args); err != nil {
+		var flagsErr *flags.Error
+		if errors.As(err, &flagsErr) && flagsErr.Type == flags.ErrHelp {
+			return 0
+		}
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type rawEntry struct {
+	name    string
+	mode    int64
+	inode   int64
+	nlink   int64
+	content string
+}
+
+// rawArchive builds a newc archive with the inode numbers and link counts
+// given, which the archive writers don't allow to be chosen freely
+func rawArchive(entries []rawEntry) []byte {
+	out := &bytes.Buffer{}
+	pad := func() {
+		for out.Len()%4 != 0 {
+			out.WriteByte(0)
+		}
+	}
+
+	entries = append(entries, rawEntry{name: "TRAILER!!!", nlink: 1})
+	for _, e := range entries {
+		fmt.Fprintf(out, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			e.inode, e.mode, 0, 0, e.nlink, 0, len(e.content), 3, 1, 0, 0, len(e.name)+1, 0)
+		out.WriteString(e.name + "\x00")
+		pad()
+		out.WriteString(e.content)
+		pad()
+	}
+	return out.Bytes()
+}
+
+func extractRaw(t *testing.T, entries []rawEntry, dir string) error {
+	initrd := path.Join(t.TempDir(), "initrd.cpio")
+	require.NoError(t, os.WriteFile(initrd, rawArchive(entries), 0644))
+
+	c := &InitrdExtractCommand{}
+	c.Args.Initrd = initrd
+	c.Args.Directory = dir
+	return c.Execute(nil)
+}
+
+func TestInitrdExtract(t *testing.T) {
+	dir := path.Join(t.TempDir(), "root")
+	err := extractRaw(t, []rawEntry{
+		{name: "dir", mode: 0o040750, inode: 1, nlink: 2},
+		{name: "dir/file", mode: 0o100644, inode: 2, nlink: 2},
+		{name: "dir/link", mode: 0o100644, inode: 2, nlink: 2, content: "content"},
+		{name: "symlink", mode: 0o120777, inode: 3, nlink: 1, content: "dir/file"},
+	}, dir)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(path.Join(dir, "dir/file"))
+	require.NoError(t, err)
+	require.Equal(t, "content", string(content))
+
+	file, err := os.Stat(path.Join(dir, "dir/file"))
+	require.NoError(t, err)
+	link, err := os.Stat(path.Join(dir, "dir/link"))
+	require.NoError(t, err)
+	require.True(t, os.SameFile(file, link))
+
+	info, err := os.Stat(path.Join(dir, "dir"))
+	require.NoError(t, err)
+	require.Equal(t, os.ModeDir|0750, info.Mode())
+
+	target, err := os.Readlink(path.Join(dir, "symlink"))
+	require.NoError(t, err)
+	require.Equal(t, "dir/file", target)
+}
+
+func TestInitrdExtractHostile(t *testing.T) {
+	outside := t.TempDir()
+	require.NoError(t, os.Chmod(outside, 0755))
+	secret := path.Join(outside, "secret")
+	require.NoError(t, os.WriteFile(secret, []byte("secret"), 0644))
+
+	for name, entries := range map[string][]rawEntry{
+		// A directory reusing an extracted symlink
+		"directory": {
+			{name: "link", mode: 0o120777, inode: 1, nlink: 1, content: outside},
+			{name: "link", mode: 0o040777, inode: 2, nlink: 2},
+		},
+		// A file reusing an extracted symlink
+		"file": {
+			{name: "link", mode: 0o120777, inode: 1, nlink: 1, content: secret},
+			{name: "link", mode: 0o100644, inode: 2, nlink: 1, content: "overwritten"},
+		},
+		// A file below an extracted symlink
+		"below": {
+			{name: "link", mode: 0o120777, inode: 1, nlink: 1, content: outside},
+			{name: "link/secret", mode: 0o100644, inode: 2, nlink: 1, content: "overwritten"},
+		},
+		// A file escaping through relative components
+		"relative": {
+			{name: "../../" + secret, mode: 0o100644, inode: 1, nlink: 1, content: "overwritten"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_ = extractRaw(t, entries, path.Join(t.TempDir(), "root"))
+
+			info, err := os.Stat(outside)
+			require.NoError(t, err)
+			require.Equal(t, os.ModeDir|0755, info.Mode())
+
+			content, err := os.ReadFile(secret)
+			require.NoError(t, err)
+			require.Equal(t, "secret", string(content))
+		})
+	}
+
+	// A file sharing the inode of an extracted symlink isn't a hardlink to
+	// it, so the symlink isn't written through
+	dir := path.Join(t.TempDir(), "root")
+	err := extractRaw(t, []rawEntry{
+		{name: "link", mode: 0o120777, inode: 1, nlink: 2, content: secret},
+		{name: "file", mode: 0o100644, inode: 1, nlink: 2, content: "overwritten"},
+	}, dir)
+	require.NoError(t, err)
+
+	content, err := os.ReadFile(secret)
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(content))
+
+	content, err = os.ReadFile(path.Join(dir, "file"))
+	require.NoError(t, err)
+	require.Equal(t, "overwritten", string(content))
+}
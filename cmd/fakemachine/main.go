@@ -2,21 +2,37 @@ package main
 
 import (
 	"al.essio.dev/pkg/shellescape"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/docker/go-units"
 	"github.com/go-debos/fakemachine"
 	"github.com/jessevdk/go-flags"
+	"net"
 	"os"
 	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var Version string
 
 type Options struct {
 	Backend     string            `short:"b" long:"backend" description:"Virtualisation backend to use" default:"auto"`
-	Volumes     []string          `short:"v" long:"volume" description:"volume to mount"`
+	Arch        string            `long:"arch" description:"Architecture of the fakemachine (defaults to the host architecture; foreign architectures are emulated and require --sysroot)"`
+	Sysroot     string            `long:"sysroot" description:"Root filesystem to base the fakemachine on instead of the host"`
+	Kernel      string            `long:"kernel" description:"Kernel image to boot (detected automatically if unset)"`
+	Modules     string            `long:"modules" description:"Kernel module directory, named after the kernel release as in /lib/modules/<release> (detected automatically if unset)"`
+	KernelArgs  []string          `long:"kernel-arg" description:"Extra kernel command line argument (can be given multiple times)"`
+	LoadModules []string          `long:"module" description:"Kernel module to add to the initramfs and load on boot (can be given multiple times)"`
+	Compress    string            `long:"compress-initrd" description:"Compression of the initramfs; auto picks a format the kernel supports" choice:"none" choice:"auto" choice:"gzip" choice:"xz" choice:"zstd" default:"none"`
+	Network     string            `long:"network" description:"Network connection of the fakemachine" choice:"user" choice:"none" default:"user"`
+	Publish     []string          `short:"p" long:"publish" description:"Forward a host port to the fakemachine (use -p [ADDRESS:]HOSTPORT:GUESTPORT[/udp] syntax; host port 0 picks a free port)"`
+	Sharing     string            `long:"volume-sharing" description:"How volumes are shared with the fakemachine; virtiofs falls back to 9p if unavailable" choice:"9p" choice:"virtiofs" default:"9p"`
+	Volumes     []string          `short:"v" long:"volume" description:"volume to mount (use -v HOSTDIR[:MACHINEDIR[:OPTIONS]] syntax; OPTIONS is a comma separated list of ro, cache=MODE, msize=SIZE and access=MODE)"`
+	Files       []string          `long:"file" description:"Single file to make available in the fakemachine (use --file HOSTFILE[:MACHINEFILE] syntax; a missing MACHINEFILE on a volume is an error)"`
 	Images      []string          `short:"i" long:"image" description:"image to add"`
 	EnvironVars map[string]string `short:"e" long:"environ-var" description:"Environment variables (use -e VARIABLE:VALUE syntax)"`
 	Memory      string            `short:"m" long:"memory" description:"Amount of memory for the fakemachine (parsed with human-readable suffix; assumed bytes if no suffix)" default:"2Gb"`
@@ -25,7 +41,9 @@ type Options struct {
 	ScratchSize string            `short:"s" long:"scratchsize" description:"On-disk scratch space size (with a unit suffix, e.g. 4G); if unset, memory backed scratch space is used"`
 	ShowBoot    bool              `long:"show-boot" description:"Show boot/console messages from the fakemachine"`
 	Quiet       bool              `short:"q" long:"quiet" description:"Don't show logs from fakemachine or the backend; only print the command's stdout/stderr"`
+	Timeout     time.Duration     `short:"t" long:"timeout" description:"Terminate the fakemachine if the command hasn't finished after this duration (e.g. 30m); exits with code 124 on timeout"`
 	Version     bool              `long:"version" description:"Print fakemachine version"`
+	Inspect     bool              `long:"inspect-initrd" description:"Inspect an initramfs instead of running a command (use --inspect-initrd list [-l] INITRD or --inspect-initrd extract INITRD DIRECTORY)"`
 }
 
 var options Options
@@ -76,6 +94,33 @@ func warnLocalhost(variable string, value string) {
 	}
 }
 
+// parseVolumeOptions parses the comma separated options of a volume
+func parseVolumeOptions(s string) (fakemachine.VolumeOptions, error) {
+	var volumeOptions fakemachine.VolumeOptions
+	for _, option := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "ro":
+			volumeOptions.ReadOnly = true
+		case "rw":
+			volumeOptions.ReadOnly = false
+		case "cache":
+			volumeOptions.Cache = value
+		case "msize":
+			msize, err := units.RAMInBytes(value)
+			if err != nil {
+				return volumeOptions, fmt.Errorf("failed to parse msize: %w", err)
+			}
+			volumeOptions.Msize = int(msize)
+		case "access":
+			volumeOptions.Access = value
+		default:
+			return volumeOptions, fmt.Errorf("unknown volume option %q", option)
+		}
+	}
+	return volumeOptions, nil
+}
+
 func SetupVolumes(m *fakemachine.Machine, options Options) {
 	for _, v := range options.Volumes {
 		parts := strings.Split(v, ":")
@@ -85,6 +130,13 @@ func SetupVolumes(m *fakemachine.Machine, options Options) {
 			m.AddVolume(parts[0])
 		case 2:
 			m.AddVolumeAt(parts[0], parts[1])
+		case 3:
+			volumeOptions, err := parseVolumeOptions(parts[2])
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to parse volume: %s %v\n", v, err)
+				os.Exit(1)
+			}
+			m.AddVolumeWithOptions(parts[0], parts[1], volumeOptions)
 		default:
 			fmt.Fprintln(os.Stderr, "Failed to parse volume:", v)
 			os.Exit(1)
@@ -92,6 +144,70 @@ func SetupVolumes(m *fakemachine.Machine, options Options) {
 	}
 }
 
+func SetupPortForwards(m *fakemachine.Machine, options Options) {
+	for _, p := range options.Publish {
+		proto := "tcp"
+		spec := p
+		if s, found := strings.CutSuffix(p, "/udp"); found {
+			proto = "udp"
+			spec = s
+		} else if s, found := strings.CutSuffix(p, "/tcp"); found {
+			spec = s
+		}
+
+		parts := strings.Split(spec, ":")
+		var address string
+		switch len(parts) {
+		case 2:
+		case 3:
+			address = parts[0]
+			parts = parts[1:]
+		default:
+			fmt.Fprintln(os.Stderr, "Failed to parse port forward:", p)
+			os.Exit(1)
+		}
+
+		hostPort, err := strconv.Atoi(parts[0])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to parse port forward:", p)
+			os.Exit(1)
+		}
+		guestPort, err := strconv.Atoi(parts[1])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to parse port forward:", p)
+			os.Exit(1)
+		}
+
+		bound, err := m.AddPortForward(proto, address, hostPort, guestPort)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to forward port: %s %v\n", p, err)
+			os.Exit(1)
+		}
+
+		// A picked port is reported even in quiet mode as it can't be known
+		// otherwise
+		if !options.Quiet || hostPort == 0 {
+			fmt.Fprintf(os.Stderr, "Forwarding %s port %s to %d\n", proto, net.JoinHostPort(address, strconv.Itoa(bound)), guestPort)
+		}
+	}
+}
+
+func SetupFiles(m *fakemachine.Machine, options Options) {
+	for _, f := range options.Files {
+		parts := strings.Split(f, ":")
+
+		switch len(parts) {
+		case 1:
+			m.AddFileVolumeAt(parts[0], parts[0])
+		case 2:
+			m.AddFileVolumeAt(parts[0], parts[1])
+		default:
+			fmt.Fprintln(os.Stderr, "Failed to parse file:", f)
+			os.Exit(1)
+		}
+	}
+}
+
 func SetupImages(m *fakemachine.Machine, options Options) {
 	for _, i := range options.Images {
 		parts := strings.Split(i, ":")
@@ -171,10 +287,18 @@ func SetupEnviron(m *fakemachine.Machine, options Options) {
 		warnLocalhost(k, v)
 		EnvironString = append(EnvironString, fmt.Sprintf("%s=%s", k, v))
 	}
+	// Keep the generated initramfs reproducible
+	sort.Strings(EnvironString)
 	m.SetEnviron(EnvironString) // And save the resulting environ vars on m
 }
 
 func main() {
+	// Given first, the options of the inspection commands are left for them
+	// to parse
+	if len(os.Args) > 1 && os.Args[1] == "--inspect-initrd" {
+		os.Exit(initrdMain(os.Args[2:]))
+	}
+
 	// append the list of available backends to the commandline argument parser
 	opt := parser.FindOptionByLongName("backend")
 	opt.Choices = fakemachine.BackendNames()
@@ -198,15 +322,37 @@ func main() {
 		return
 	}
 
-	m, err := fakemachine.NewMachineWithBackend(options.Backend)
+	if options.Inspect {
+		os.Exit(initrdMain(args))
+	}
+
+	m, err := fakemachine.NewMachineWithOptions(fakemachine.MachineOptions{
+		Backend: options.Backend,
+		Arch:    fakemachine.Arch(options.Arch),
+		Sysroot: options.Sysroot,
+	})
 	if err != nil {
 		fmt.Printf("fakemachine: %v\n", err)
 		os.Exit(1)
 	}
 
+	m.SetKernel(options.Kernel, options.Modules)
+	m.AddKernelModules(options.LoadModules...)
+	if err := m.SetNetwork(fakemachine.Network(options.Network)); err != nil {
+		fmt.Fprintf(os.Stderr, "fakemachine: %v\n", err)
+		os.Exit(1)
+	}
+	m.SetVolumeSharing(fakemachine.VolumeSharing(options.Sharing))
+	m.SetInitrdCompression(fakemachine.Compression(options.Compress))
+	if err := m.AppendKernelArgs(options.KernelArgs); err != nil {
+		fmt.Fprintf(os.Stderr, "fakemachine: %v\n", err)
+		os.Exit(1)
+	}
 	m.SetShowBoot(options.ShowBoot)
 	m.SetQuiet(options.Quiet)
 	SetupVolumes(m, options)
+	SetupFiles(m, options)
+	SetupPortForwards(m, options)
 	SetupImages(m, options)
 	SetupEnviron(m, options)
 
@@ -246,9 +392,22 @@ func main() {
 		command = shellescape.QuoteCommand(args)
 	}
 
-	ret, err := m.Run(command)
+	ctx := context.Background()
+	if options.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, options.Timeout)
+		defer cancel()
+	}
+
+	ret, err := m.RunContext(ctx, command)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "fakemachine: %v\n", err)
+
+		// Follow timeout(1) and exit with 124 if the command timed out
+		var terminatedErr *fakemachine.TerminatedError
+		if errors.As(err, &terminatedErr) && terminatedErr.Timeout() {
+			ret = 124
+		}
 	}
 	os.Exit(ret)
 }
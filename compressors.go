@@ -0,0 +1,72 @@
+package fakemachine
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// Compression is the compression format of the initramfs
+type Compression string
+
+const (
+	// CompressionNone leaves the initramfs uncompressed (the default)
+	CompressionNone Compression = "none"
+	// CompressionAuto picks a format the kernel of the machine supports
+	CompressionAuto Compression = "auto"
+	// CompressionGzip compresses the initramfs with gzip
+	CompressionGzip Compression = "gzip"
+	// CompressionXz compresses the initramfs with xz
+	CompressionXz Compression = "xz"
+	// CompressionZstd compresses the initramfs with zstd
+	CompressionZstd Compression = "zstd"
+)
+
+// Kernel config options needed to unpack an initramfs compressed in a format,
+// in order of preference when picking one automatically
+var compressionKernelConfig = []struct {
+	compression Compression
+	option      string
+}{
+	{CompressionZstd, "CONFIG_RD_ZSTD"},
+	{CompressionGzip, "CONFIG_RD_GZIP"},
+	{CompressionXz, "CONFIG_RD_XZ"},
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// newCompressor returns a writer compressing the data written to it into w
+// using compression. Closing the writer doesn't close w.
+func newCompressor(compression Compression, w io.Writer) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+	case CompressionGzip:
+		return gzip.NewWriter(w), nil
+	case CompressionXz:
+		// The kernel only supports CRC32 checksums
+		config := xz.WriterConfig{CheckSum: xz.CRC32}
+		compressor, err := config.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create xz compressor: %w", err)
+		}
+		return compressor, nil
+	case CompressionZstd:
+		compressor, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd compressor: %w", err)
+		}
+		return compressor, nil
+	}
+
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
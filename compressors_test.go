@@ -0,0 +1,39 @@
+package fakemachine
+
+import (
+	"bytes"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/go-debos/fakemachine/cpio"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressors(t *testing.T) {
+	data, err := os.ReadFile(path.Join("testdata", "test"))
+	require.NoError(t, err)
+
+	for compression, d := range map[Compression]writerhelper.Transformer{
+		CompressionNone: NullDecompressor,
+		CompressionGzip: GzipDecompressor,
+		CompressionXz:   XzDecompressor,
+		CompressionZstd: ZstdDecompressor,
+	} {
+		t.Run(string(compression), func(t *testing.T) {
+			compressed := new(bytes.Buffer)
+			w, err := newCompressor(compression, compressed)
+			require.NoError(t, err)
+			_, err = w.Write(data)
+			require.NoError(t, err)
+			require.NoError(t, w.Close())
+
+			output := new(bytes.Buffer)
+			require.NoError(t, d(output, compressed))
+			require.Equal(t, data, output.Bytes())
+		})
+	}
+
+	_, err = newCompressor(CompressionAuto, new(bytes.Buffer))
+	require.Error(t, err)
+}
@@ -0,0 +1,306 @@
+package writerhelper
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/surma/gocpio"
+	"github.com/ulikunitz/xz"
+)
+
+// Entry is an entry read from an archive
+type Entry struct {
+	cpio.Header
+	// Inode is the inode number of the entry within its archive
+	Inode int64
+	// Hardlink is the name of an earlier regular file of the same archive
+	// this regular file is a hardlink of, if any
+	Hardlink string
+}
+
+// FileMode returns the type and permissions of the entry
+func (e *Entry) FileMode() os.FileMode {
+	mode := os.FileMode(e.Mode & 0777)
+	if e.Mode&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if e.Mode&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if e.Mode&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	switch e.Type {
+	case cpio.TYPE_DIR:
+		mode |= os.ModeDir
+	case cpio.TYPE_SYMLINK:
+		mode |= os.ModeSymlink
+	case cpio.TYPE_CHAR:
+		mode |= os.ModeDevice | os.ModeCharDevice
+	case cpio.TYPE_BLK:
+		mode |= os.ModeDevice
+	case cpio.TYPE_FIFO:
+		mode |= os.ModeNamedPipe
+	case cpio.TYPE_SOCK:
+		mode |= os.ModeSocket
+	}
+	return mode
+}
+
+const headerSize = 110
+
+// maxNameSize limits the length of entry names, including the terminating
+// zero, to PATH_MAX like the kernel does
+const maxNameSize = 4096 + 1
+
+var compressionMagics = []struct {
+	magic []byte
+	open  func(io.Reader) (io.Reader, func(), error)
+}{
+	{[]byte{0x1f, 0x8b}, func(r io.Reader) (io.Reader, func(), error) {
+		d, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		return d, func() {}, nil
+	}},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, func(r io.Reader) (io.Reader, func(), error) {
+		d, err := xz.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open xz stream: %w", err)
+		}
+		return d, func() {}, nil
+	}},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, func(r io.Reader) (io.Reader, func(), error) {
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open zstd stream: %w", err)
+		}
+		return d, d.Close, nil
+	}},
+}
+
+// Reader reads cpio archives in the newc format. Like the kernel does for an
+// initramfs, concatenated archives are read as one and each of them may be
+// compressed with gzip, xz or zstd. All data following a compressed archive
+// has to be compressed in the same format though.
+type Reader struct {
+	r          *bufio.Reader
+	offset     int64
+	remaining  int64
+	compressed bool
+	release    func()
+	// Names of the hardlinked regular files of the current archive by inode
+	links map[int64]string
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r:       bufio.NewReader(r),
+		release: func() {},
+		links:   map[int64]string{},
+	}
+}
+
+// Close releases the resources of the decompressor, if any. The underlying
+// reader isn't closed.
+func (r *Reader) Close() error {
+	r.release()
+	return nil
+}
+
+// Next advances to the next entry, returning io.EOF after the last one. The
+// trailers of the archives aren't returned.
+func (r *Reader) Next() (*Entry, error) {
+	for {
+		if err := r.skip(r.remaining); err != nil {
+			return nil, err
+		}
+		r.remaining = 0
+		if err := r.align(); err != nil {
+			return nil, err
+		}
+
+		if err := r.findHeader(); err != nil {
+			return nil, err
+		}
+
+		entry, err := r.readHeader()
+		if err != nil {
+			return nil, err
+		}
+
+		// Inode numbers are only unique within an archive
+		if entry.Name == "TRAILER!!!" {
+			r.links = map[int64]string{}
+			continue
+		}
+
+		return entry, nil
+	}
+}
+
+// findHeader skips the padding between archives and switches to
+// decompressing the data on finding a compressed archive. It returns io.EOF
+// at the end of the data.
+func (r *Reader) findHeader() error {
+	for {
+		magic, err := r.r.Peek(6)
+		if len(magic) == 0 && errors.Is(err, io.EOF) {
+			return io.EOF
+		} else if len(magic) == 0 {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		if magic[0] == 0 {
+			if err := r.skip(1); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if bytes.HasPrefix(magic, []byte("07070")) {
+			return nil
+		}
+
+		if r.compressed {
+			return fmt.Errorf("unexpected data at offset %d of compressed archive", r.offset)
+		}
+
+		for _, c := range compressionMagics {
+			if !bytes.HasPrefix(magic, c.magic) {
+				continue
+			}
+
+			d, release, err := c.open(r.r)
+			if err != nil {
+				return err
+			}
+			r.r = bufio.NewReader(d)
+			r.release = release
+			r.compressed = true
+			// Alignment is relative to the start of the decompressed data
+			r.offset = 0
+			break
+		}
+		if !r.compressed {
+			return fmt.Errorf("unknown data at offset %d of archive", r.offset)
+		}
+	}
+}
+
+func (r *Reader) readHeader() (*Entry, error) {
+	hdr := make([]byte, headerSize)
+	if err := r.readFull(hdr); err != nil {
+		return nil, err
+	}
+
+	magic := string(hdr[:6])
+	if magic != "070701" && magic != "070702" {
+		return nil, fmt.Errorf("unsupported cpio format %q, only newc is supported", magic)
+	}
+
+	var fields [13]int64
+	for i := range fields {
+		field := hdr[6+8*i : 14+8*i]
+		v, err := strconv.ParseUint(string(field), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpio header field %q: %w", field, err)
+		}
+		fields[i] = int64(v)
+	}
+
+	// Check the name size before allocating anything for it
+	if namesize := fields[11]; namesize == 0 || namesize > maxNameSize {
+		return nil, fmt.Errorf("invalid cpio name size %d at offset %d", namesize, r.offset-headerSize)
+	}
+	name := make([]byte, fields[11])
+	if err := r.readFull(name); err != nil {
+		return nil, err
+	}
+	if err := r.align(); err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{
+		Header: cpio.Header{
+			Mode:     fields[1] & 0xfff,
+			Uid:      int(fields[2]),
+			Gid:      int(fields[3]),
+			Mtime:    fields[5],
+			Size:     fields[6],
+			Devmajor: fields[9],
+			Devminor: fields[10],
+			Type:     fields[1] >> 12 & 0xf,
+			Name:     string(bytes.TrimRight(name, "\x00")),
+		},
+		Inode: fields[0],
+	}
+
+	// Only regular files are treated as hardlinks, so consumers never end up
+	// writing content through a link to a symlink or device
+	if nlink := fields[4]; nlink > 1 && entry.Type == cpio.TYPE_REG {
+		if first, ok := r.links[entry.Inode]; ok {
+			entry.Hardlink = first
+		} else {
+			r.links[entry.Inode] = entry.Name
+		}
+	}
+
+	r.remaining = entry.Size
+	return entry, nil
+}
+
+// Read reads the content of the current entry
+func (r *Reader) Read(b []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+
+	n, err := r.r.Read(b)
+	r.offset += int64(n)
+	r.remaining -= int64(n)
+	if errors.Is(err, io.EOF) {
+		if r.remaining > 0 {
+			return n, io.ErrUnexpectedEOF
+		}
+		return n, nil
+	} else if err != nil {
+		return n, fmt.Errorf("failed to read archive: %w", err)
+	}
+	return n, nil
+}
+
+func (r *Reader) readFull(b []byte) error {
+	n, err := io.ReadFull(r.r, b)
+	r.offset += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	return nil
+}
+
+func (r *Reader) skip(n int64) error {
+	skipped, err := r.r.Discard(int(n))
+	r.offset += int64(skipped)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %w", err)
+	}
+	return nil
+}
+
+// align skips the padding up to the next multiple of 4 bytes
+func (r *Reader) align() error {
+	return r.skip((4 - r.offset%4) % 4)
+}
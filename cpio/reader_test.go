@@ -0,0 +1,81 @@
+package writerhelper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/require"
+	"github.com/surma/gocpio"
+)
+
+func TestReaderConcatenated(t *testing.T) {
+	out := &bytes.Buffer{}
+
+	// An uncompressed archive followed by compressed ones, like an initramfs
+	// with early microcode
+	w := NewWriterHelper(out)
+	require.NoError(t, w.WriteFile("/kernel/x86/microcode/GenuineIntel.bin", "microcode", 0644))
+	require.NoError(t, w.Close())
+
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	w = NewWriterHelper(gz)
+	require.NoError(t, w.WriteFile("/etc/hostname", "fakemachine", 0644))
+	require.NoError(t, w.WriteCharDevice("/dev/console", 5, 1, 0600))
+	require.NoError(t, w.Close())
+	require.NoError(t, gz.Close())
+
+	gz = gzip.NewWriter(compressed)
+	w = NewAppendingWriterHelper(gz, w.Index())
+	require.NoError(t, w.WriteSymlink("/run", "/var/run", 0777))
+	require.NoError(t, w.Close())
+	require.NoError(t, gz.Close())
+
+	_, err := io.Copy(out, compressed)
+	require.NoError(t, err)
+
+	entries := readArchive(t, out.Bytes())
+	require.Equal(t, "microcode", entries["/kernel/x86/microcode/GenuineIntel.bin"].content)
+	require.Equal(t, "fakemachine", entries["/etc/hostname"].content)
+	require.Equal(t, int64(cpio.TYPE_DIR), entries["/etc"].Type)
+	require.Equal(t, int64(cpio.TYPE_CHAR), entries["/dev/console"].Type)
+	require.Equal(t, int64(5), entries["/dev/console"].Devmajor)
+	require.Equal(t, int64(1), entries["/dev/console"].Devminor)
+	require.Equal(t, "/run", entries["/var/run"].content)
+	require.Equal(t, os.ModeSymlink|0777, entries["/var/run"].FileMode())
+	require.Equal(t, os.ModeDevice|os.ModeCharDevice|0600, entries["/dev/console"].FileMode())
+}
+
+func TestReaderZstd(t *testing.T) {
+	compressed := &bytes.Buffer{}
+	zw, err := zstd.NewWriter(compressed)
+	require.NoError(t, err)
+	w := NewWriterHelper(zw)
+	require.NoError(t, w.WriteFile("/etc/hostname", "fakemachine", 0644))
+	require.NoError(t, w.Close())
+	require.NoError(t, zw.Close())
+
+	entries := readArchive(t, compressed.Bytes())
+	require.Equal(t, "fakemachine", entries["/etc/hostname"].content)
+}
+
+func TestReaderInvalid(t *testing.T) {
+	r := NewReader(bytes.NewReader([]byte("not an archive")))
+	_, err := r.Next()
+	require.Error(t, err)
+}
+
+func TestReaderNameSize(t *testing.T) {
+	for _, namesize := range []int64{0, maxNameSize + 1, 0xffffffff} {
+		hdr := fmt.Sprintf("070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			721, 0o100644, 0, 0, 1, 0, 0, 3, 1, 0, 0, namesize, 0)
+		r := NewReader(bytes.NewReader([]byte(hdr)))
+		_, err := r.Next()
+		require.ErrorContains(t, err, "invalid cpio name size", "name size %d", namesize)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package writerhelper
+
+import "os"
+
+type fileID struct{}
+
+type fileStat struct {
+	id       fileID
+	nlink    uint64
+	devmajor int64
+	devminor int64
+}
+
+// statFile isn't supported on this platform, so hardlinks and devices can't
+// be copied
+func statFile(info os.FileInfo) (fileStat, bool) {
+	return fileStat{}, false
+}
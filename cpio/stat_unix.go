@@ -0,0 +1,41 @@
+//go:build unix
+
+package writerhelper
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileID identifies a file on the host, entries with the same fileID are
+// hardlinks of each other
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+type fileStat struct {
+	id       fileID
+	nlink    uint64
+	devmajor int64
+	devminor int64
+}
+
+// statFile returns the host specific details of the file described by info
+func statFile(info os.FileInfo) (fileStat, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileStat{}, false
+	}
+
+	// The types of the fields differ between platforms
+	rdev := uint64(st.Rdev)
+	return fileStat{
+		id:       fileID{uint64(st.Dev), uint64(st.Ino)},
+		nlink:    uint64(st.Nlink),
+		devmajor: int64(unix.Major(rdev)),
+		devminor: int64(unix.Minor(rdev)),
+	}, true
+}
@@ -0,0 +1,214 @@
+package writerhelper
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/surma/gocpio"
+)
+
+// TransformJob is a file to write to the archive with TransformFilesTo
+type TransformJob struct {
+	Src string
+	Dst string
+	Fn  Transformer
+	// Size is optional, see TransformSizedFileTo
+	Size Sizer
+}
+
+// transformToTemp transforms src by fn into a temporary file in dir, which is
+// returned positioned at its end
+func transformToTemp(src *os.File, dir string, fn Transformer) (_ *os.File, err error) {
+	tmp, err := os.CreateTemp(dir, "fakemachine-transform-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			err = errors.Join(err, closeTemp(tmp))
+		}
+	}()
+
+	err = fn(tmp, src)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transform source file %s: %w", src.Name(), err)
+	}
+	return tmp, nil
+}
+
+// closeTemp closes and removes the temporary file tmp
+func closeTemp(tmp *os.File) error {
+	var err error
+	if closeErr := tmp.Close(); closeErr != nil {
+		err = fmt.Errorf("failed to close temporary file: %w", closeErr)
+	}
+	if removeErr := os.Remove(tmp.Name()); removeErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to remove temporary file: %w", removeErr))
+	}
+	return err
+}
+
+// writeTransformed writes the entry hdr with the transformed content in tmp,
+// which gets closed and removed
+func (w *WriterHelper) writeTransformed(hdr *cpio.Header, tmp *os.File) (err error) {
+	defer func() {
+		err = errors.Join(err, closeTemp(tmp))
+	}()
+
+	hdr.Size, err = tmp.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to get size of transformed file: %w", err)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to rewind transformed file: %w", err)
+	}
+
+	err = w.WriteHeader(hdr)
+	if err != nil {
+		return fmt.Errorf("failed to write header for transformed file %s: %w", hdr.Name, err)
+	}
+
+	_, err = io.Copy(w, tmp)
+	if err != nil {
+		return fmt.Errorf("failed to copy transformed content: %w", err)
+	}
+
+	return nil
+}
+
+type transformed struct {
+	tmp  *os.File
+	mode os.FileMode
+	err  error
+}
+
+// transformJob transforms the source file of job into a temporary file. If
+// the size of the transformed content is known it is checked against that.
+func transformJob(job TransformJob) (result transformed) {
+	f, err := os.Open(job.Src)
+	if err != nil {
+		return transformed{err: fmt.Errorf("failed to open source file %s: %w", job.Src, err)}
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			result.err = errors.Join(result.err, fmt.Errorf("failed to close source file %s: %w", job.Src, closeErr))
+		}
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return transformed{err: fmt.Errorf("failed to stat source file %s: %w", job.Src, err)}
+	}
+
+	size, err := transformedSize(f, job.Size)
+	if err != nil {
+		return transformed{err: err}
+	}
+
+	tmp, err := transformToTemp(f, "", job.Fn)
+	if err != nil {
+		return transformed{err: err}
+	}
+
+	if size >= 0 {
+		n, err := tmp.Seek(0, io.SeekCurrent)
+		if err != nil {
+			err = fmt.Errorf("failed to get size of transformed file: %w", err)
+		} else if n > size {
+			err = fmt.Errorf("failed to transform source file %s: %w", job.Src, ErrWriteTooLong)
+		} else if n < size {
+			err = fmt.Errorf("transformed %s to %d bytes less than expected", job.Src, size-n)
+		}
+		if err != nil {
+			return transformed{err: errors.Join(err, closeTemp(tmp))}
+		}
+	}
+	return transformed{tmp: tmp, mode: info.Mode()}
+}
+
+// TransformFilesTo writes the files of jobs transformed to the archive. Up to
+// workers files are transformed concurrently into temporary files, while they
+// are written to the archive in order, so the archive is the same as when
+// using TransformSizedFileTo for each of them. The Size of a job, if known, is
+// only used to check the transformed content.
+func (w *WriterHelper) TransformFilesTo(jobs []TransformJob, workers int) (err error) {
+	if workers <= 1 {
+		for _, job := range jobs {
+			if err := w.TransformSizedFileTo(job.Src, job.Dst, job.Fn, job.Size); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	results := make([]chan transformed, len(jobs))
+	for i := range results {
+		results[i] = make(chan transformed, 1)
+	}
+
+	// Transformations are started as earlier files are written, which bounds
+	// how many temporary files exist at a time
+	slots := make(chan struct{}, workers)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	defer func() {
+		close(done)
+		wg.Wait()
+		// Clean up transformations which finished after an error
+		for _, r := range results {
+			select {
+			case result := <-r:
+				if result.tmp != nil {
+					err = errors.Join(err, closeTemp(result.tmp))
+				}
+			default:
+			}
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, job := range jobs {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i] <- transformJob(job)
+			}()
+		}
+	}()
+
+	for i, job := range jobs {
+		result := <-results[i]
+		if result.err != nil {
+			return result.err
+		}
+
+		if err := w.ensureBaseDirectory(path.Dir(job.Dst)); err != nil {
+			return errors.Join(err, closeTemp(result.tmp))
+		}
+
+		hdr := new(cpio.Header)
+		hdr.Type = cpio.TYPE_REG
+		hdr.Name = job.Dst
+		hdr.Mode = int64(result.mode & ^os.ModeType)
+
+		if err := w.writeTransformed(hdr, result.tmp); err != nil {
+			return err
+		}
+		<-slots
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package writerhelper
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func upperTransformer(dst io.Writer, src io.Reader) error {
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(bytes.ToUpper(data))
+	return err
+}
+
+// sourceSize is a Sizer for transformations keeping the size
+func sourceSize(src io.ReadSeeker) (int64, error) {
+	return src.Seek(0, io.SeekEnd)
+}
+
+func TestTransformFilesTo(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	src := t.TempDir()
+	var jobs []TransformJob
+	for i := 0; i < 50; i++ {
+		file := path.Join(src, fmt.Sprintf("file%d", i))
+		content := bytes.Repeat([]byte{'a' + byte(i%26)}, 1000*i)
+		require.NoError(t, os.WriteFile(file, content, 0644))
+		job := TransformJob{
+			Src: file,
+			Dst: fmt.Sprintf("/dir%d/file%d", i%7, i),
+			Fn:  upperTransformer,
+		}
+		if i%3 == 0 {
+			job.Size = sourceSize
+		}
+		jobs = append(jobs, job)
+	}
+
+	transform := func(workers int) ([]byte, error) {
+		out := &bytes.Buffer{}
+		w := NewWriterHelper(out)
+		if err := w.TransformFilesTo(jobs, workers); err != nil {
+			return nil, err
+		}
+		require.NoError(t, w.Close())
+		return out.Bytes(), nil
+	}
+
+	sequential, err := transform(1)
+	require.NoError(t, err)
+	entries := readArchive(t, sequential)
+	require.Equal(t, "CCC", entries["/dir2/file2"].content[:3])
+
+	for _, workers := range []int{2, 8, 64} {
+		parallel, err := transform(workers)
+		require.NoError(t, err)
+		require.Equal(t, sequential, parallel, "%d workers", workers)
+	}
+
+	// Files of a known size are checked against it
+	jobs[21].Size = func(src io.ReadSeeker) (int64, error) { return 1, nil }
+	_, err = transform(8)
+	require.ErrorIs(t, err, ErrWriteTooLong)
+	jobs[21].Size = func(src io.ReadSeeker) (int64, error) { return 1 << 20, nil }
+	_, err = transform(8)
+	require.ErrorContains(t, err, "less than expected")
+	jobs[21].Size = sourceSize
+
+	// Failing jobs stop the transformation without leaking temporary files
+	jobs[20].Src = path.Join(src, "missing")
+	_, err = transform(8)
+	require.Error(t, err)
+
+	leftover, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	require.Empty(t, leftover)
+}
+
+func TestTransformFilesToConcurrent(t *testing.T) {
+	src := t.TempDir()
+
+	// Each transformation waits for the other to start, so they only finish
+	// if both run at the same time, even though their size is known
+	started := make(chan struct{}, 2)
+	waitForOther := func(dst io.Writer, src io.Reader) error {
+		started <- struct{}{}
+		timeout := time.After(10 * time.Second)
+		for len(started) < 2 {
+			select {
+			case <-timeout:
+				return errors.New("transformations not running concurrently")
+			case <-time.After(time.Millisecond):
+			}
+		}
+		return upperTransformer(dst, src)
+	}
+
+	var jobs []TransformJob
+	for i := 0; i < 2; i++ {
+		file := path.Join(src, fmt.Sprintf("file%d", i))
+		require.NoError(t, os.WriteFile(file, []byte("content"), 0644))
+		jobs = append(jobs, TransformJob{
+			Src:  file,
+			Dst:  fmt.Sprintf("/file%d", i),
+			Fn:   waitForOther,
+			Size: sourceSize,
+		})
+	}
+
+	out := &bytes.Buffer{}
+	w := NewWriterHelper(out)
+	require.NoError(t, w.TransformFilesTo(jobs, 2))
+	require.NoError(t, w.Close())
+
+	entries := readArchive(t, out.Bytes())
+	require.Equal(t, "CONTENT", entries["/file1"].content)
+}
@@ -0,0 +1,129 @@
+package writerhelper
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/surma/gocpio"
+)
+
+// Writer writes cpio archives in the newc format. It produces the same
+// archives as the gocpio writer, but also allows entries to share an inode
+// number so hardlinks can be expressed.
+type Writer struct {
+	w         io.Writer
+	inode     int64
+	length    int64
+	remaining int64
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:     w,
+		inode: 721,
+	}
+}
+
+// newInode allocates an inode number for an entry
+func (w *Writer) newInode() int64 {
+	inode := w.inode
+	w.inode++
+	return inode
+}
+
+// WriteHeader starts a new entry with its own inode. Writes to w afterwards
+// are the content of the entry, up to hdr.Size bytes.
+func (w *Writer) WriteHeader(hdr *cpio.Header) error {
+	nlink := 1
+	if hdr.Type == cpio.TYPE_DIR {
+		nlink = 2
+	}
+	return w.writeHeader(hdr, w.newInode(), nlink)
+}
+
+func (w *Writer) writeHeader(hdr *cpio.Header, inode int64, nlink int) error {
+	// Pad the content of the previous entry to its declared size
+	if err := w.zeros(w.remaining); err != nil {
+		return err
+	}
+	if err := w.pad(4); err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf("070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		inode,
+		hdr.Mode&0xfff|(hdr.Type&0xf)<<12,
+		hdr.Uid,
+		hdr.Gid,
+		nlink,
+		hdr.Mtime,
+		hdr.Size,
+		3, // major of the archive device
+		1, // minor of the archive device
+		hdr.Devmajor,
+		hdr.Devminor,
+		len(hdr.Name)+1, // including the terminating zero
+		0)               // checksum, unused by the newc format
+	if err := w.write([]byte(header)); err != nil {
+		return err
+	}
+	if err := w.write(append([]byte(hdr.Name), 0)); err != nil {
+		return err
+	}
+
+	w.remaining = hdr.Size
+	return w.pad(4)
+}
+
+// ErrWriteTooLong is returned when writing more content than the size of the
+// current entry
+var ErrWriteTooLong = errors.New("write beyond the size of the entry")
+
+// Write writes content of the current entry
+func (w *Writer) Write(b []byte) (int, error) {
+	tooLong := int64(len(b)) > w.remaining
+	if tooLong {
+		b = b[:w.remaining]
+	}
+	n, err := w.w.Write(b)
+	w.length += int64(n)
+	w.remaining -= int64(n)
+	if err != nil {
+		return n, fmt.Errorf("failed to write archive: %w", err)
+	}
+	if tooLong {
+		return n, ErrWriteTooLong
+	}
+	return n, nil
+}
+
+func (w *Writer) write(b []byte) error {
+	n, err := w.w.Write(b)
+	w.length += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+func (w *Writer) zeros(n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	return w.write(make([]byte, n))
+}
+
+// pad brings the length of the archive to a multiple of mod
+func (w *Writer) pad(mod int64) error {
+	return w.zeros((mod - w.length%mod) % mod)
+}
+
+// Close writes the trailer of the archive, padded to a multiple of 512 bytes.
+// The underlying writer isn't closed.
+func (w *Writer) Close() error {
+	if err := w.WriteHeader(&cpio.Header{Name: "TRAILER!!!"}); err != nil {
+		return err
+	}
+	return w.pad(512)
+}
@@ -1,21 +1,24 @@
 package writerhelper
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/surma/gocpio"
 )
 
 type WriterHelper struct {
-	paths map[string]bool
-	*cpio.Writer
+	paths   map[string]bool
+	entries map[string]bool
+	mtime   int64
+	*Writer
 }
 
 type WriteDirectory struct {
@@ -29,13 +32,102 @@ type WriteSymlink struct {
 	Perm   os.FileMode
 }
 
+// Index lists the entries written to an archive
+type Index struct {
+	Directories []string
+	Entries     []string
+}
+
 type Transformer func(dst io.Writer, src io.Reader) error
 
+// Sizer returns the size of the output of a Transformer for src without
+// transforming it, or -1 if it can't be determined upfront
+type Sizer func(src io.ReadSeeker) (int64, error)
+
 func NewWriterHelper(f io.Writer) *WriterHelper {
-	return &WriterHelper{
-		paths:  map[string]bool{"/": true},
-		Writer: cpio.NewWriter(f),
+	return NewAppendingWriterHelper(f, Index{})
+}
+
+// NewAppendingWriterHelper creates a WriterHelper for an archive which gets
+// concatenated to the archive described by index. Directories of the previous
+// archive aren't written again and its entries are reported by Contains.
+func NewAppendingWriterHelper(f io.Writer, index Index) *WriterHelper {
+	w := &WriterHelper{
+		paths:   map[string]bool{"/": true},
+		entries: map[string]bool{"/": true},
+		mtime:   sourceDateEpoch(),
+		Writer:  NewWriter(f),
+	}
+	for _, d := range index.Directories {
+		w.paths[d] = true
+	}
+	for _, e := range index.Entries {
+		w.entries[e] = true
+	}
+	return w
+}
+
+// Index returns the entries written to the archive so far, including those
+// of the archive it is appended to
+func (w *WriterHelper) Index() Index {
+	var index Index
+	for d := range w.paths {
+		index.Directories = append(index.Directories, d)
+	}
+	for e := range w.entries {
+		index.Entries = append(index.Entries, e)
+	}
+	sort.Strings(index.Directories)
+	sort.Strings(index.Entries)
+	return index
+}
+
+// sourceDateEpoch returns the modification time of all entries, taken from
+// SOURCE_DATE_EPOCH if set so archives are reproducible:
+// https://reproducible-builds.org/specs/source-date-epoch/
+func sourceDateEpoch() int64 {
+	epoch, err := strconv.ParseInt(os.Getenv("SOURCE_DATE_EPOCH"), 10, 64)
+	if err != nil || epoch < 0 {
+		return 0
 	}
+	return epoch
+}
+
+// WriteHeader writes hdr to the archive, recording the entry it starts. The
+// ownership and modification time of the entry are normalised as the
+// archive only depends on the content of the files it is generated from.
+func (w *WriterHelper) WriteHeader(hdr *cpio.Header) error {
+	return w.writeHeader(hdr, w.Writer.WriteHeader)
+}
+
+// writeLinkHeader writes hdr as one of nlink hardlinks sharing inode
+func (w *WriterHelper) writeLinkHeader(hdr *cpio.Header, inode int64, nlink int) error {
+	return w.writeHeader(hdr, func(hdr *cpio.Header) error {
+		return w.Writer.writeHeader(hdr, inode, nlink)
+	})
+}
+
+func (w *WriterHelper) writeHeader(hdr *cpio.Header, write func(*cpio.Header) error) error {
+	hdr.Uid = 0
+	hdr.Gid = 0
+	hdr.Mtime = w.mtime
+
+	if err := write(hdr); err != nil {
+		return fmt.Errorf("failed to write header for %s: %w", hdr.Name, err)
+	}
+	w.entries[path.Clean(hdr.Name)] = true
+	return nil
+}
+
+// Contains returns whether an entry for p has been written to the archive
+func (w *WriterHelper) Contains(p string) bool {
+	return w.entries[path.Clean(p)]
+}
+
+// IsDirectory returns whether a directory entry for p has been written to
+// the archive
+func (w *WriterHelper) IsDirectory(p string) bool {
+	return w.paths[path.Clean(p)]
 }
 
 func (w *WriterHelper) ensureBaseDirectory(directory string) error {
@@ -160,49 +252,168 @@ func (w *WriterHelper) WriteSymlink(target, link string, perm os.FileMode) error
 }
 
 func (w *WriterHelper) WriteCharDevice(device string, major, minor int64, perm os.FileMode) error {
-	err := w.ensureBaseDirectory(path.Dir(device))
+	err := w.writeSpecial(device, cpio.TYPE_CHAR, major, minor, perm)
+	if err != nil {
+		return fmt.Errorf("failed to write character device header: %w", err)
+	}
+	return nil
+}
+
+func (w *WriterHelper) WriteBlockDevice(device string, major, minor int64, perm os.FileMode) error {
+	err := w.writeSpecial(device, cpio.TYPE_BLK, major, minor, perm)
+	if err != nil {
+		return fmt.Errorf("failed to write block device header: %w", err)
+	}
+	return nil
+}
+
+func (w *WriterHelper) WriteFifo(fifo string, perm os.FileMode) error {
+	err := w.writeSpecial(fifo, cpio.TYPE_FIFO, 0, 0, perm)
+	if err != nil {
+		return fmt.Errorf("failed to write fifo header: %w", err)
+	}
+	return nil
+}
+
+// writeSpecial writes an entry without content
+func (w *WriterHelper) writeSpecial(name string, typ, major, minor int64, perm os.FileMode) error {
+	err := w.ensureBaseDirectory(path.Dir(name))
 	if err != nil {
 		return err
 	}
 	hdr := new(cpio.Header)
 
-	hdr.Type = cpio.TYPE_CHAR
-	hdr.Name = device
+	hdr.Type = typ
+	hdr.Name = name
 	hdr.Mode = int64(perm)
 	hdr.Devmajor = major
 	hdr.Devminor = minor
 
-	err = w.WriteHeader(hdr)
-	if err != nil {
-		return fmt.Errorf("failed to write character device header: %w", err)
-	}
-	return nil
+	return w.WriteHeader(hdr)
 }
 
 func (w *WriterHelper) CopyTree(path string) error {
+	return w.CopyTreeTo(path, path)
+}
+
+// CopyTreeTo copies the directory tree src to dst in the archive. Symlinks,
+// FIFOs and devices are copied as such, absolute symlinks pointing into src
+// are remapped to point into dst. Files hardlinked within the tree are
+// written once, with further links referring to it by inode number.
+func (w *WriterHelper) CopyTreeTo(src, dst string) error {
+	// Count the links to each file within the tree, links from outside of
+	// it don't end up in the archive
+	links := map[fileID]int{}
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("error visiting %s: %w", p, err)
+		}
+		if st, ok := statFile(info); ok && info.Mode().IsRegular() && st.nlink > 1 {
+			links[st.id]++
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to walk directory %s: %w", src, err)
+	}
+
+	// Inode numbers of the hardlinked files written so far
+	inodes := map[fileID]int64{}
+
 	walker := func(p string, info os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("error visiting %s: %w", p, err)
 		}
-		if info.Mode().IsDir() {
-			err = w.WriteDirectory(p, info.Mode() & ^os.ModeType)
-		} else if info.Mode().IsRegular() {
-			err = w.CopyFile(p)
-		} else {
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return fmt.Errorf("failed to get relative path of %s: %w", p, err)
+		}
+		target := path.Join(dst, rel)
+
+		mode := info.Mode()
+		st, ok := statFile(info)
+
+		switch {
+		case mode.IsDir():
+			err = w.WriteDirectory(target, mode & ^os.ModeType)
+		case mode.IsRegular() && ok && links[st.id] > 1:
+			err = w.copyHardlinkTo(p, target, info, inodes, st.id, links[st.id])
+		case mode.IsRegular():
+			err = w.CopyFileTo(p, target)
+		case mode&os.ModeSymlink != 0:
+			err = w.copySymlinkTo(p, target, src, dst, mode.Perm())
+		case mode&os.ModeNamedPipe != 0:
+			err = w.WriteFifo(target, mode.Perm())
+		case mode&os.ModeDevice != 0 && ok:
+			if mode&os.ModeCharDevice != 0 {
+				err = w.WriteCharDevice(target, st.devmajor, st.devminor, mode.Perm())
+			} else {
+				err = w.WriteBlockDevice(target, st.devmajor, st.devminor, mode.Perm())
+			}
+		default:
 			err = fmt.Errorf("file type not handled for %s", p)
 		}
 
 		return err
 	}
 
-	err := filepath.Walk(path, walker)
+	err = filepath.Walk(src, walker)
 	if err != nil {
-		return fmt.Errorf("failed to walk directory %s: %w", path, err)
+		return fmt.Errorf("failed to walk directory %s: %w", src, err)
 	}
 	return nil
 }
 
-func (w *WriterHelper) CopyFileTo(src, dst string) (err error) {
+// copySymlinkTo copies the symlink src to dst, remapping its target if it is
+// an absolute path within the tree srcTree copied to dstTree
+func (w *WriterHelper) copySymlinkTo(src, dst, srcTree, dstTree string, perm os.FileMode) error {
+	target, err := os.Readlink(src)
+	if err != nil {
+		return fmt.Errorf("failed to read symlink %s: %w", src, err)
+	}
+
+	if path.IsAbs(target) {
+		tree, err := filepath.Abs(srcTree)
+		if err != nil {
+			return fmt.Errorf("failed to get absolute path of %s: %w", srcTree, err)
+		}
+		if rel, err := filepath.Rel(tree, target); err == nil && filepath.IsLocal(rel) {
+			target = path.Join(dstTree, rel)
+		}
+	}
+
+	return w.WriteSymlink(target, dst, perm)
+}
+
+// copyHardlinkTo copies src, one of nlink links to the file id, to dst. The
+// content is only written for the first link, the others share its inode.
+func (w *WriterHelper) copyHardlinkTo(src, dst string, info os.FileInfo, inodes map[fileID]int64, id fileID, nlink int) error {
+	if inode, ok := inodes[id]; ok {
+		if err := w.ensureBaseDirectory(path.Dir(dst)); err != nil {
+			return err
+		}
+
+		hdr := new(cpio.Header)
+		hdr.Type = cpio.TYPE_REG
+		hdr.Name = dst
+		hdr.Mode = int64(info.Mode() & ^os.ModeType)
+
+		return w.writeLinkHeader(hdr, inode, nlink)
+	}
+
+	inode := w.Writer.newInode()
+	inodes[id] = inode
+	return w.copyFileTo(src, dst, func(hdr *cpio.Header) error {
+		return w.writeLinkHeader(hdr, inode, nlink)
+	})
+}
+
+func (w *WriterHelper) CopyFileTo(src, dst string) error {
+	return w.copyFileTo(src, dst, w.WriteHeader)
+}
+
+func (w *WriterHelper) copyFileTo(src, dst string, writeHeader func(*cpio.Header) error) (err error) {
 	if err := w.ensureBaseDirectory(path.Dir(dst)); err != nil {
 		return err
 	}
@@ -229,7 +440,7 @@ func (w *WriterHelper) CopyFileTo(src, dst string) (err error) {
 	hdr.Mode = int64(info.Mode() & ^os.ModeType)
 	hdr.Size = info.Size()
 
-	err = w.WriteHeader(hdr)
+	err = writeHeader(hdr)
 	if err != nil {
 		return fmt.Errorf("failed to write file header for %s: %w", dst, err)
 	}
@@ -242,7 +453,16 @@ func (w *WriterHelper) CopyFileTo(src, dst string) (err error) {
 	return nil
 }
 
-func (w *WriterHelper) TransformFileTo(src, dst string, fn Transformer) (err error) {
+// TransformFileTo writes src transformed by fn to dst. As the size of the
+// output isn't known upfront it is transformed into a temporary file first.
+func (w *WriterHelper) TransformFileTo(src, dst string, fn Transformer) error {
+	return w.TransformSizedFileTo(src, dst, fn, nil)
+}
+
+// TransformSizedFileTo writes src transformed by fn to dst. If size knows the
+// size of the output the transformation is streamed straight into the
+// archive, otherwise it goes through a temporary file.
+func (w *WriterHelper) TransformSizedFileTo(src, dst string, fn Transformer, size Sizer) (err error) {
 	if err := w.ensureBaseDirectory(path.Dir(dst)); err != nil {
 		return err
 	}
@@ -262,31 +482,67 @@ func (w *WriterHelper) TransformFileTo(src, dst string, fn Transformer) (err err
 		return fmt.Errorf("failed to stat source file %s: %w", src, err)
 	}
 
-	out := new(bytes.Buffer)
-	err = fn(out, f)
-	if err != nil {
-		return fmt.Errorf("failed to transform source file %s: %w", src, err)
-	}
-
 	hdr := new(cpio.Header)
 	hdr.Type = cpio.TYPE_REG
 	hdr.Name = dst
 	hdr.Mode = int64(info.Mode() & ^os.ModeType)
-	hdr.Size = int64(out.Len())
 
-	err = w.WriteHeader(hdr)
+	hdr.Size, err = transformedSize(f, size)
 	if err != nil {
-		return fmt.Errorf("failed to write header for transformed file %s: %w", dst, err)
+		return err
 	}
+	if hdr.Size < 0 {
+		return w.transformBuffered(f, hdr, fn)
+	}
+	return w.writeStreamed(hdr, f, fn)
+}
 
-	_, err = io.Copy(w, out)
+// transformedSize returns the size of src transformed as told by size, or -1
+// if it isn't known. src is rewound afterwards.
+func transformedSize(src *os.File, size Sizer) (int64, error) {
+	if size == nil {
+		return -1, nil
+	}
+
+	n, err := size(src)
 	if err != nil {
-		return fmt.Errorf("failed to copy transformed content: %w", err)
+		return 0, fmt.Errorf("failed to get transformed size of %s: %w", src.Name(), err)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to rewind source file %s: %w", src.Name(), err)
+	}
+	return n, nil
+}
+
+// writeStreamed writes the entry hdr with src transformed by fn straight into
+// the archive, the transformed content has to be hdr.Size bytes
+func (w *WriterHelper) writeStreamed(hdr *cpio.Header, src *os.File, fn Transformer) error {
+	err := w.WriteHeader(hdr)
+	if err != nil {
+		return fmt.Errorf("failed to write header for transformed file %s: %w", hdr.Name, err)
+	}
+
+	err = fn(w, src)
+	if err != nil {
+		return fmt.Errorf("failed to transform source file %s: %w", src.Name(), err)
+	}
+	if w.Writer.remaining != 0 {
+		return fmt.Errorf("transformed %s to %d bytes less than expected", src.Name(), w.Writer.remaining)
 	}
 
 	return nil
 }
 
+// transformBuffered transforms src into a temporary file to find the size of
+// the output before writing it to the archive
+func (w *WriterHelper) transformBuffered(src *os.File, hdr *cpio.Header, fn Transformer) error {
+	tmp, err := transformToTemp(src, "", fn)
+	if err != nil {
+		return err
+	}
+	return w.writeTransformed(hdr, tmp)
+}
+
 func (w *WriterHelper) CopyFile(in string) error {
 	return w.CopyFileTo(in, in)
 }
@@ -0,0 +1,146 @@
+package writerhelper
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/surma/gocpio"
+	"golang.org/x/sys/unix"
+)
+
+func writeTestArchive(t *testing.T) []byte {
+	out := &bytes.Buffer{}
+	w := NewWriterHelper(out)
+	require.NoError(t, w.CopyTreeTo("../testdata", "/testdata"))
+	require.NoError(t, w.WriteFile("/etc/hostname", "fakemachine", 0444))
+	require.NoError(t, w.WriteSymlink("/run", "/var/run", 0755))
+	require.NoError(t, w.Close())
+	return out.Bytes()
+}
+
+func TestReproducible(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1700000000")
+
+	first := writeTestArchive(t)
+	second := writeTestArchive(t)
+	require.Equal(t, sha256.Sum256(first), sha256.Sum256(second))
+
+	r := cpio.NewReader(bytes.NewReader(first))
+	for {
+		hdr, err := r.Next()
+		require.NoError(t, err)
+		if hdr.IsTrailer() {
+			break
+		}
+		require.Equal(t, int64(1700000000), hdr.Mtime, hdr.Name)
+		require.Zero(t, hdr.Uid, hdr.Name)
+		require.Zero(t, hdr.Gid, hdr.Name)
+	}
+}
+
+type archiveEntry struct {
+	*Entry
+	content string
+}
+
+// readArchive returns the entries in the archive data by name
+func readArchive(t *testing.T, data []byte) map[string]archiveEntry {
+	entries := map[string]archiveEntry{}
+	r := NewReader(bytes.NewReader(data))
+	defer r.Close()
+	for {
+		entry, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(r)
+		require.NoError(t, err)
+		entries[entry.Name] = archiveEntry{entry, string(content)}
+	}
+	return entries
+}
+
+func TestCopyTree(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.MkdirAll(path.Join(src, "dir"), 0755))
+	require.NoError(t, os.WriteFile(path.Join(src, "file"), []byte("content"), 0644))
+	require.NoError(t, os.Link(path.Join(src, "file"), path.Join(src, "dir", "link")))
+	require.NoError(t, os.Symlink("file", path.Join(src, "relative")))
+	require.NoError(t, os.Symlink(path.Join(src, "dir"), path.Join(src, "absolute")))
+	require.NoError(t, os.Symlink("/etc/passwd", path.Join(src, "outside")))
+	require.NoError(t, unix.Mkfifo(path.Join(src, "fifo"), 0600))
+
+	out := &bytes.Buffer{}
+	w := NewWriterHelper(out)
+	require.NoError(t, w.CopyTreeTo(src, "/tree"))
+	require.NoError(t, w.Close())
+
+	headers := readArchive(t, out.Bytes())
+
+	// Absolute symlinks into the tree follow it to its new location
+	for link, target := range map[string]string{
+		"/tree/relative": "file",
+		"/tree/absolute": "/tree/dir",
+		"/tree/outside":  "/etc/passwd",
+	} {
+		require.Equal(t, int64(cpio.TYPE_SYMLINK), headers[link].Type, link)
+		require.Equal(t, target, headers[link].content, link)
+	}
+	require.Equal(t, int64(cpio.TYPE_FIFO), headers["/tree/fifo"].Type)
+	require.Equal(t, int64(0600), headers["/tree/fifo"].Mode&0777)
+
+	// The content of hardlinked files is only stored once
+	require.Equal(t, int64(cpio.TYPE_REG), headers["/tree/dir/link"].Type)
+	require.Equal(t, int64(cpio.TYPE_REG), headers["/tree/file"].Type)
+	require.Equal(t, "content", headers["/tree/dir/link"].content+headers["/tree/file"].content)
+	require.Equal(t, headers["/tree/dir/link"].Inode, headers["/tree/file"].Inode)
+	require.NotEqual(t, headers["/tree/dir"].Inode, headers["/tree/file"].Inode)
+	require.Equal(t, "/tree/dir/link", headers["/tree/file"].Hardlink)
+}
+
+func TestTransformFile(t *testing.T) {
+	src := path.Join(t.TempDir(), "src")
+	require.NoError(t, os.WriteFile(src, []byte("content"), 0644))
+
+	sizer := func(size int64) Sizer {
+		return func(src io.ReadSeeker) (int64, error) {
+			return size, nil
+		}
+	}
+
+	transform := func(size Sizer) ([]byte, error) {
+		out := &bytes.Buffer{}
+		w := NewWriterHelper(out)
+		if err := w.TransformSizedFileTo(src, "/dst", upperTransformer, size); err != nil {
+			return nil, err
+		}
+		require.NoError(t, w.Close())
+		return out.Bytes(), nil
+	}
+
+	// Streamed and buffered transformations give the same archive
+	buffered, err := transform(nil)
+	require.NoError(t, err)
+	require.Equal(t, "CONTENT", readArchive(t, buffered)["/dst"].content)
+
+	streamed, err := transform(sizer(int64(len("CONTENT"))))
+	require.NoError(t, err)
+	require.Equal(t, buffered, streamed)
+
+	unknown, err := transform(sizer(-1))
+	require.NoError(t, err)
+	require.Equal(t, buffered, unknown)
+
+	// The output has to match the announced size
+	_, err = transform(sizer(3))
+	require.ErrorIs(t, err, ErrWriteTooLong)
+	_, err = transform(sizer(10))
+	require.Error(t, err)
+}
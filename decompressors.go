@@ -1,15 +1,72 @@
 package fakemachine
 
 import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 
+	writerhelper "github.com/go-debos/fakemachine/cpio"
 	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
 	"github.com/ulikunitz/xz"
 )
 
+// decompressor is a compression format recognised by the magic bytes the
+// data starts with
+type decompressor struct {
+	magic []byte
+	fn    writerhelper.Transformer
+	// size is nil if the decompressed size isn't recorded by the format
+	size writerhelper.Sizer
+}
+
+var decompressors = []decompressor{
+	// gzip only records the size of the last member, modulo 4 GiB, so the
+	// size of the whole data can't be told without decompressing it
+	{[]byte{0x1f, 0x8b}, GzipDecompressor, nil},
+	{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, XzDecompressor, XzSize},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, ZstdDecompressor, ZstdSize},
+	{[]byte("BZh"), Bzip2Decompressor, nil},
+	{[]byte{0x04, 0x22, 0x4d, 0x18}, Lz4Decompressor, Lz4Size},
+	// Legacy format of lz4 -l, as used for the kernel
+	{[]byte{0x02, 0x21, 0x4c, 0x18}, Lz4Decompressor, nil},
+}
+
+// detectDecompressor picks the decompressor for the data in r from its
+// magic bytes, data not starting with any of them is taken as uncompressed
+func detectDecompressor(r io.Reader) (decompressor, error) {
+	magic := make([]byte, 6)
+	n, err := io.ReadFull(r, magic)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return decompressor{}, fmt.Errorf("failed to read magic bytes: %w", err)
+	}
+
+	for _, d := range decompressors {
+		if bytes.HasPrefix(magic[:n], d.magic) {
+			return d, nil
+		}
+	}
+	return decompressor{nil, NullDecompressor, NullSize}, nil
+}
+
+// DetectDecompressor returns the Transformer decompressing the data in r,
+// based on the magic bytes at its start rather than a file name. Uncompressed
+// data is passed through unchanged. The magic bytes are consumed from r, so
+// the data has to be read from the returned reader, which replays them.
+func DetectDecompressor(r io.Reader) (writerhelper.Transformer, io.Reader, error) {
+	magic := new(bytes.Buffer)
+	d, err := detectDecompressor(io.TeeReader(r, magic))
+	if err != nil {
+		return nil, nil, err
+	}
+	return d.fn, io.MultiReader(magic, r), nil
+}
+
 func ZstdDecompressor(dst io.Writer, src io.Reader) error {
 	decompressor, err := zstd.NewReader(src)
 	if err != nil {
@@ -57,6 +114,32 @@ func GzipDecompressor(dst io.Writer, src io.Reader) (err error) {
 	return nil
 }
 
+func Bzip2Decompressor(dst io.Writer, src io.Reader) error {
+	_, err := io.Copy(dst, bzip2.NewReader(src))
+	if err != nil {
+		return fmt.Errorf("failed to decompress bzip2 data: %w", err)
+	}
+	return nil
+}
+
+func Lz4Decompressor(dst io.Writer, src io.Reader) error {
+	// The lz4 reader stops at the end of a frame, so restart it for any
+	// frames concatenated to it
+	r := bufio.NewReader(src)
+	decompressor := lz4.NewReader(r)
+	for {
+		if _, err := io.Copy(dst, decompressor); err != nil {
+			return fmt.Errorf("failed to decompress lz4 data: %w", err)
+		}
+		if _, err := r.Peek(1); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read lz4 data: %w", err)
+		}
+		decompressor.Reset(r)
+	}
+}
+
 func NullDecompressor(dst io.Writer, src io.Reader) error {
 	_, err := io.Copy(dst, src)
 	if err != nil {
@@ -64,3 +147,192 @@ func NullDecompressor(dst io.Writer, src io.Reader) error {
 	}
 	return nil
 }
+
+// ZstdSize returns the decompressed size of zstd data from its frame header,
+// or -1 if the data isn't a single frame recording its size
+func ZstdSize(src io.ReadSeeker) (int64, error) {
+	buf := make([]byte, zstd.HeaderMaxSize)
+	n, err := io.ReadFull(src, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return 0, fmt.Errorf("failed to read zstd header: %w", err)
+	}
+
+	var h zstd.Header
+	if err := h.Decode(buf[:n]); err != nil {
+		return 0, fmt.Errorf("failed to decode zstd header: %w", err)
+	}
+	if !h.HasFCS || h.Skippable {
+		return -1, nil
+	}
+
+	// The header only describes the first frame, so walk its blocks to make
+	// sure no other frame follows it
+	offset := int64(h.HeaderSize)
+	block := make([]byte, 3)
+	for last := false; !last; {
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("failed to seek to zstd block: %w", err)
+		}
+		if _, err := io.ReadFull(src, block); err != nil {
+			return 0, fmt.Errorf("failed to read zstd block header: %w", err)
+		}
+		header := uint32(block[0]) | uint32(block[1])<<8 | uint32(block[2])<<16
+		last = header&1 != 0
+		size := int64(header >> 3)
+		// RLE blocks store the repeated byte only
+		if header>>1&3 == 1 {
+			size = 1
+		}
+		offset += int64(len(block)) + size
+	}
+	if h.HasCheckSum {
+		offset += 4
+	}
+
+	end, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to seek to end of zstd data: %w", err)
+	}
+	if offset != end {
+		return -1, nil
+	}
+	return int64(h.FrameContentSize), nil
+}
+
+// readVarint reads a multibyte integer as used by the xz index
+func readVarint(b []byte) (uint64, []byte, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 9; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i]&0x80 == 0 {
+			return v, b[i+1:], nil
+		}
+	}
+	return 0, nil, errors.New("invalid xz index")
+}
+
+// XzSize returns the decompressed size of xz data from its index, or -1 if
+// it isn't a single stream
+func XzSize(src io.ReadSeeker) (int64, error) {
+	const headerSize, footerSize = 12, 12
+
+	end, err := src.Seek(-footerSize, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to seek to xz footer: %w", err)
+	}
+	footer := make([]byte, footerSize)
+	if _, err := io.ReadFull(src, footer); err != nil {
+		return 0, fmt.Errorf("failed to read xz footer: %w", err)
+	}
+	// Stream padding or concatenated streams aren't handled
+	if string(footer[10:]) != "YZ" {
+		return -1, nil
+	}
+
+	indexSize := (int64(binary.LittleEndian.Uint32(footer[4:8])) + 1) * 4
+	if indexSize > end-headerSize {
+		return 0, errors.New("invalid xz footer")
+	}
+	if _, err := src.Seek(end-indexSize, io.SeekStart); err != nil {
+		return 0, fmt.Errorf("failed to seek to xz index: %w", err)
+	}
+	index := make([]byte, indexSize)
+	if _, err := io.ReadFull(src, index); err != nil {
+		return 0, fmt.Errorf("failed to read xz index: %w", err)
+	}
+	if index[0] != 0 {
+		return 0, errors.New("invalid xz index")
+	}
+
+	records, b, err := readVarint(index[1:])
+	if err != nil {
+		return 0, err
+	}
+
+	var blocks, size uint64
+	for i := uint64(0); i < records; i++ {
+		var unpadded, uncompressed uint64
+		if unpadded, b, err = readVarint(b); err != nil {
+			return 0, err
+		}
+		if uncompressed, b, err = readVarint(b); err != nil {
+			return 0, err
+		}
+		blocks += (unpadded + 3) &^ 3
+		size += uncompressed
+	}
+
+	// The index only describes the last stream, so make sure there is no
+	// other one in front of it
+	if int64(blocks) != end-indexSize-headerSize {
+		return -1, nil
+	}
+	return int64(size), nil
+}
+
+// Lz4Size returns the decompressed size of lz4 data from its frame
+// descriptor, or -1 if the data isn't a single frame recording its size
+func Lz4Size(src io.ReadSeeker) (int64, error) {
+	// Magic bytes, FLG and BD byte followed by the optional content size
+	header := make([]byte, 14)
+	if _, err := io.ReadFull(src, header[:6]); err != nil {
+		return 0, fmt.Errorf("failed to read lz4 header: %w", err)
+	}
+	flags := header[4]
+	if flags&0x08 == 0 {
+		return -1, nil
+	}
+
+	if _, err := io.ReadFull(src, header[6:]); err != nil {
+		return 0, fmt.Errorf("failed to read lz4 content size: %w", err)
+	}
+	size := int64(binary.LittleEndian.Uint64(header[6:]))
+
+	// The descriptor only describes the first frame, so walk its blocks to
+	// make sure no other frame follows it. The descriptor ends with the
+	// optional dictionary id and a checksum byte.
+	offset := int64(len(header)) + 1
+	if flags&0x01 != 0 {
+		offset += 4
+	}
+	block := make([]byte, 4)
+	for {
+		if _, err := src.Seek(offset, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("failed to seek to lz4 block: %w", err)
+		}
+		if _, err := io.ReadFull(src, block); err != nil {
+			return 0, fmt.Errorf("failed to read lz4 block size: %w", err)
+		}
+		offset += int64(len(block))
+		// The highest bit marks uncompressed blocks
+		blockSize := int64(binary.LittleEndian.Uint32(block) &^ (1 << 31))
+		if blockSize == 0 {
+			break
+		}
+		offset += blockSize
+		if flags&0x10 != 0 {
+			offset += 4
+		}
+	}
+	if flags&0x04 != 0 {
+		offset += 4
+	}
+
+	end, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to seek to end of lz4 data: %w", err)
+	}
+	if offset != end {
+		return -1, nil
+	}
+	return size, nil
+}
+
+// NullSize returns the size of uncompressed data
+func NullSize(src io.ReadSeeker) (int64, error) {
+	size, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size: %w", err)
+	}
+	return size, nil
+}
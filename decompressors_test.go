@@ -100,7 +100,98 @@ func TestGzip(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestBzip2(t *testing.T) {
+	err := decompressorTest("test", ".bz2", Bzip2Decompressor)
+	require.NoError(t, err)
+}
+
+func TestLz4(t *testing.T) {
+	err := decompressorTest("test", ".lz4", Lz4Decompressor)
+	require.NoError(t, err)
+}
+
+func TestLz4Legacy(t *testing.T) {
+	err := decompressorTest("test", ".lz4legacy", Lz4Decompressor)
+	require.NoError(t, err)
+}
+
 func TestNull(t *testing.T) {
 	err := decompressorTest("test", "", NullDecompressor)
 	require.NoError(t, err)
 }
+
+func TestDecompressedSize(t *testing.T) {
+	info, err := os.Stat(path.Join("testdata", "test"))
+	require.NoError(t, err)
+
+	for suffix, size := range map[string]writerhelper.Sizer{
+		"":     NullSize,
+		".xz":  XzSize,
+		".zst": ZstdSize,
+		".lz4": Lz4Size,
+	} {
+		f, err := os.Open(path.Join("testdata", "test"+suffix))
+		require.NoError(t, err)
+		defer f.Close()
+
+		n, err := size(f)
+		require.NoError(t, err, suffix)
+		require.Equal(t, info.Size(), n, suffix)
+	}
+}
+
+func TestMultiFrame(t *testing.T) {
+	info, err := os.Stat(path.Join("testdata", "multi"))
+	require.NoError(t, err)
+
+	for _, suffix := range []string{".gz", ".xz", ".zst", ".bz2", ".lz4", ".lz4legacy"} {
+		f, err := os.Open(path.Join("testdata", "multi"+suffix))
+		require.NoError(t, err)
+		defer f.Close()
+
+		d, err := detectDecompressor(f)
+		require.NoError(t, err, suffix)
+		require.NoError(t, decompressorTest("multi", suffix, d.fn), suffix)
+
+		// Sizes of the first frame only must not be taken for the whole
+		if d.size != nil {
+			_, err = f.Seek(0, io.SeekStart)
+			require.NoError(t, err)
+			n, err := d.size(f)
+			require.NoError(t, err, suffix)
+			require.Contains(t, []int64{-1, info.Size()}, n, suffix)
+		}
+
+		out := new(bytes.Buffer)
+		w := writerhelper.NewWriterHelper(out)
+		require.NoError(t, w.TransformSizedFileTo(path.Join("testdata", "multi"+suffix), "/multi", d.fn, d.size), suffix)
+		require.NoError(t, w.Close())
+	}
+}
+
+func TestDetectDecompressor(t *testing.T) {
+	for _, suffix := range []string{"", ".gz", ".xz", ".zst", ".bz2", ".lz4", ".lz4legacy"} {
+		f, err := os.Open(path.Join("testdata", "test"+suffix))
+		require.NoError(t, err)
+		defer f.Close()
+
+		d, r, err := DetectDecompressor(f)
+		require.NoError(t, err, suffix)
+
+		// The detected decompressor has to handle the data read for
+		// detecting it
+		output := new(bytes.Buffer)
+		require.NoError(t, d(output, r), suffix)
+
+		check, err := os.Open(path.Join("testdata", "test"))
+		require.NoError(t, err)
+		defer check.Close()
+		require.NoError(t, checkStreamsMatch(output, check), suffix)
+	}
+
+	d, r, err := DetectDecompressor(bytes.NewReader([]byte("ab")))
+	require.NoError(t, err)
+	output := new(bytes.Buffer)
+	require.NoError(t, d(output, r))
+	require.Equal(t, "ab", output.String())
+}
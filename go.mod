@@ -7,6 +7,7 @@ require (
 	github.com/docker/go-units v0.5.0
 	github.com/jessevdk/go-flags v1.6.1
 	github.com/klauspost/compress v1.19.0
+	github.com/pierrec/lz4/v4 v4.1.22
 	github.com/stretchr/testify v1.11.1
 	github.com/surma/gocpio v1.1.0
 	github.com/ulikunitz/xz v0.5.15
@@ -0,0 +1,333 @@
+//go:build linux && (arm64 || amd64 || riscv64 || arm || 386 || ppc64le)
+
+package fakemachine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	writerhelper "github.com/go-debos/fakemachine/cpio"
+)
+
+// Version of the static initramfs layout, needs to be increased whenever
+// writeStaticInitrd changes so stale cache entries aren't used
+const initrdCacheVersion = 2
+
+// Cache entries which haven't been used for this long are removed
+const initrdCacheMaxAge = 30 * 24 * time.Hour
+
+// initrdCacheDir returns the directory the static initramfs is cached in,
+// creating it if needed
+func initrdCacheDir() (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find cache directory: %w", err)
+	}
+
+	dir := path.Join(cache, "fakemachine")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	return dir, nil
+}
+
+// initrdCacheKey identifies the static part of the initramfs by everything it
+// is generated from
+func (m *Machine) initrdCacheKey(kernelModuleDir string, compression Compression) (string, error) {
+	release, err := m.backend.KernelRelease()
+	if err != nil {
+		return "", fmt.Errorf("failed to get kernel release: %w", err)
+	}
+
+	files, err := m.staticInitrdFiles(kernelModuleDir)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "version %d\n", initrdCacheVersion)
+	fmt.Fprintf(h, "source-date-epoch %s\n", os.Getenv("SOURCE_DATE_EPOCH"))
+	fmt.Fprintf(h, "compression %s\n", compression)
+	fmt.Fprintf(h, "backend %s\n", m.backend.Name())
+	fmt.Fprintf(h, "arch %s\n", m.arch)
+	fmt.Fprintf(h, "root %s\n", m.rootPath("/"))
+	fmt.Fprintf(h, "merged-usr %t\n", m.mergedUsr)
+	fmt.Fprintf(h, "release %s\n", release)
+	fmt.Fprintf(h, "modules %s\n", kernelModuleDir)
+	fmt.Fprintf(h, "init-modules %q\n", m.initrdModules())
+	fmt.Fprintf(h, "udev-rules %q\n", m.backend.UdevRules())
+
+	for _, file := range files {
+		if err := hashFile(h, file); err != nil {
+			return "", err
+		}
+	}
+
+	// Modules rebuilt for the same release, e.g. by DKMS, usually leave the
+	// files generated by depmod unchanged
+	if modules := m.initrdModules(); len(modules) > 0 {
+		db, err := m.kernelModuleDB(kernelModuleDir)
+		if err != nil {
+			return "", fmt.Errorf("failed to load kernel modules: %w", err)
+		}
+		resolved, err := db.resolve(modules)
+		if err != nil {
+			return "", err
+		}
+		for _, mod := range resolved {
+			if err := hashFileInfo(h, mod.path); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFileInfo adds the name, size and modification time of file to h, which
+// is much cheaper than hashing the content of large files
+func hashFileInfo(h io.Writer, file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", file, err)
+	}
+	fmt.Fprintf(h, "info %s %d %d\n", file, info.Size(), info.ModTime().UnixNano())
+	return nil
+}
+
+// hashFile adds the name and content of file to h, a missing file is hashed
+// as such
+func hashFile(h io.Writer, file string) (err error) {
+	f, err := os.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintf(h, "missing %s\n", file)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open %s: %w", file, err)
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close %s: %w", file, closeErr))
+		}
+	}()
+
+	fmt.Fprintf(h, "file %s\n", file)
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to hash %s: %w", file, err)
+	}
+	return nil
+}
+
+// writeCachedInitrd writes the static part of the initramfs to f, compressed
+// with compression, and returns its index. A cached copy is used if there is
+// one, otherwise it is generated and added to the cache. If the cache can't be
+// used the static part is generated straight into f.
+func (m *Machine) writeCachedInitrd(f io.Writer, compression Compression) (writerhelper.Index, error) {
+	kernelModuleDir, err := m.backend.ModulePath()
+	if err != nil {
+		return writerhelper.Index{}, fmt.Errorf("failed to get kernel module directory: %w", err)
+	}
+
+	key, err := m.initrdCacheKey(kernelModuleDir, compression)
+	if err != nil {
+		return writerhelper.Index{}, err
+	}
+
+	dir, err := initrdCacheDir()
+	if err != nil {
+		if !m.quiet {
+			fmt.Printf("Not caching initramfs: %v\n", err)
+		}
+		return m.writeUncachedInitrd(f, kernelModuleDir, compression)
+	}
+
+	archive := path.Join(dir, key+".cpio")
+	indexFile := path.Join(dir, key+".json")
+
+	// Regenerate entries which are missing or got corrupted
+	index, err := readInitrdIndex(indexFile)
+	var cached *os.File
+	if err == nil {
+		cached, err = os.Open(archive)
+	}
+	if err != nil {
+		index, err = m.cacheStaticInitrd(dir, archive, indexFile, kernelModuleDir, compression)
+		if err != nil {
+			return writerhelper.Index{}, err
+		}
+		cached, err = os.Open(archive)
+		if err != nil {
+			return writerhelper.Index{}, fmt.Errorf("failed to open cached initramfs: %w", err)
+		}
+	}
+
+	err = copyInto(f, cached)
+	if closeErr := cached.Close(); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("failed to close cached initramfs: %w", closeErr))
+	}
+	if err != nil {
+		return writerhelper.Index{}, err
+	}
+
+	// Mark the entry as used, so only entries which are no longer in use
+	// expire
+	now := time.Now()
+	for _, file := range []string{archive, indexFile} {
+		_ = os.Chtimes(file, now, now)
+	}
+	if err := pruneInitrdCache(dir, now.Add(-initrdCacheMaxAge)); err != nil && !m.quiet {
+		fmt.Printf("Not cleaning up initramfs cache: %v\n", err)
+	}
+
+	return index, nil
+}
+
+// pruneInitrdCache removes the cache entries, and temporary files left behind
+// by interrupted runs, in dir which were last used before expiry
+func pruneInitrdCache(dir string, expiry time.Time) error {
+	var errs []error
+	for _, pattern := range []string{"*.cpio", "*.json", "*.tmp"} {
+		files, err := filepath.Glob(path.Join(dir, pattern))
+		if err != nil {
+			return fmt.Errorf("failed to list cache entries: %w", err)
+		}
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil || !info.ModTime().Before(expiry) {
+				continue
+			}
+			// Concurrent runs prune the same cache, so another one may
+			// have removed the entry already
+			if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// writeUncachedInitrd generates the static part of the initramfs into f
+func (m *Machine) writeUncachedInitrd(f io.Writer, kernelModuleDir string, compression Compression) (writerhelper.Index, error) {
+	cw, err := newCompressor(compression, f)
+	if err != nil {
+		return writerhelper.Index{}, err
+	}
+
+	w := writerhelper.NewWriterHelper(cw)
+	if err := m.writeStaticInitrd(w, kernelModuleDir); err != nil {
+		return writerhelper.Index{}, errors.Join(err, cw.Close())
+	}
+	if err := w.Close(); err != nil {
+		return writerhelper.Index{}, errors.Join(fmt.Errorf("failed to close cpio writer: %w", err), cw.Close())
+	}
+	if err := cw.Close(); err != nil {
+		return writerhelper.Index{}, fmt.Errorf("failed to close compressor: %w", err)
+	}
+	return w.Index(), nil
+}
+
+// cacheStaticInitrd generates the static part of the initramfs and adds it to
+// the cache in dir. Both files are renamed into place, the index last, so
+// concurrent runs never see a partial entry.
+func (m *Machine) cacheStaticInitrd(dir, archive, indexFile, kernelModuleDir string, compression Compression) (_ writerhelper.Index, err error) {
+	tmp, err := os.CreateTemp(dir, "initramfs-*.tmp")
+	if err != nil {
+		return writerhelper.Index{}, fmt.Errorf("failed to create cache file: %w", err)
+	}
+	defer func() {
+		if closeErr := tmp.Close(); closeErr != nil && !errors.Is(closeErr, os.ErrClosed) {
+			err = errors.Join(err, fmt.Errorf("failed to close cache file: %w", closeErr))
+		}
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	// The cached archive is the same for all users of the cache directory
+	if err := tmp.Chmod(0644); err != nil {
+		return writerhelper.Index{}, fmt.Errorf("failed to set permissions of cache file: %w", err)
+	}
+
+	index, err := m.writeUncachedInitrd(tmp, kernelModuleDir, compression)
+	if err != nil {
+		return writerhelper.Index{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return writerhelper.Index{}, fmt.Errorf("failed to close cache file: %w", err)
+	}
+
+	data, err := json.Marshal(index)
+	if err != nil {
+		return writerhelper.Index{}, fmt.Errorf("failed to encode initramfs index: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), archive); err != nil {
+		return writerhelper.Index{}, fmt.Errorf("failed to add initramfs to cache: %w", err)
+	}
+
+	if err := writeFileAtomic(dir, indexFile, data); err != nil {
+		return writerhelper.Index{}, fmt.Errorf("failed to add initramfs index to cache: %w", err)
+	}
+
+	return index, nil
+}
+
+// writeFileAtomic writes data to a temporary file in dir which is then
+// renamed to file
+func writeFileAtomic(dir, file string, data []byte) (err error) {
+	tmp, err := os.CreateTemp(dir, path.Base(file)+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); closeErr != nil {
+		err = errors.Join(err, closeErr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("failed to rename %s: %w", tmp.Name(), err)
+	}
+	return nil
+}
+
+// readInitrdIndex reads the index of a cached static initramfs
+func readInitrdIndex(indexFile string) (writerhelper.Index, error) {
+	var index writerhelper.Index
+
+	data, err := os.ReadFile(indexFile)
+	if err != nil {
+		return index, fmt.Errorf("failed to read initramfs index: %w", err)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("failed to decode initramfs index %s: %w", indexFile, err)
+	}
+	return index, nil
+}
+
+// copyInto copies the content of the file src to w
+func copyInto(w io.Writer, src *os.File) error {
+	if _, err := io.Copy(w, src); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src.Name(), err)
+	}
+	return nil
+}
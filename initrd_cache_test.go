@@ -0,0 +1,39 @@
+package fakemachine
+
+import (
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneInitrdCache(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	old := now.Add(-2 * initrdCacheMaxAge)
+
+	files := map[string]time.Time{
+		"used.cpio":       now,
+		"used.json":       now,
+		"unused.cpio":     old,
+		"unused.json":     old,
+		"initramfs-1.tmp": old,
+		"initramfs-2.tmp": now,
+		"unrelated":       old,
+	}
+	for file, mtime := range files {
+		require.NoError(t, os.WriteFile(path.Join(dir, file), nil, 0644))
+		require.NoError(t, os.Chtimes(path.Join(dir, file), mtime, mtime))
+	}
+
+	require.NoError(t, pruneInitrdCache(dir, now.Add(-initrdCacheMaxAge)))
+
+	for _, file := range []string{"used.cpio", "used.json", "initramfs-2.tmp", "unrelated"} {
+		require.FileExists(t, path.Join(dir, file))
+	}
+	for _, file := range []string{"unused.cpio", "unused.json", "initramfs-1.tmp"} {
+		require.NoFileExists(t, path.Join(dir, file))
+	}
+}
@@ -1,14 +1,15 @@
-//go:build linux && (arm64 || amd64)
+//go:build linux && (arm64 || amd64 || riscv64 || arm || 386 || ppc64le)
 
 package fakemachine
 
 import (
 	"al.essio.dev/pkg/shellescape"
-	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/exec"
 	"path"
@@ -18,169 +19,440 @@ import (
 	"strconv"
 	"strings"
 	"text/template"
+	"unicode"
 
 	writerhelper "github.com/go-debos/fakemachine/cpio"
 )
 
-func mergedUsrSystem() (bool, error) {
-	f, err := os.Lstat("/bin")
+func mergedUsrSystem(root string) (bool, error) {
+	bin := path.Join(root, "/bin")
+	f, err := os.Lstat(bin)
 	if err != nil {
-		return false, fmt.Errorf("failed to stat '/bin': %w", err)
+		return false, fmt.Errorf("failed to stat '%s': %w", bin, err)
 	}
 
 	return (f.Mode() & os.ModeSymlink) == os.ModeSymlink, nil
 }
 
-// Parse modinfo output and return the value of module attributes
-// There may be multiple row with same fieldname so []string
-// is used to return all data.
-func getModData(modname string, fieldname string, kernelRelease string) ([]string, error) {
-	out, err := exec.Command("modinfo", "-k", kernelRelease, modname).Output()
+// moduleDecompressor returns how to decompress the module file at p. The
+// compression is detected from the content as the suffix of the file can't
+// be relied upon.
+func moduleDecompressor(p string) (_ decompressor, err error) {
+	f, err := os.Open(p)
 	if err != nil {
-		return nil, fmt.Errorf("failed to call modinfo for module %q and kernel release %q: %w", modname, kernelRelease, err)
+		return decompressor{}, fmt.Errorf("failed to open module file %q: %w", p, err)
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close module file %q: %w", p, closeErr))
+		}
+	}()
+
+	d, err := detectDecompressor(f)
+	if err != nil {
+		return decompressor{}, fmt.Errorf("failed to detect compression of module file %q: %w", p, err)
+	}
+
+	// A compression suffix on a file which doesn't look compressed most
+	// likely means an unsupported format
+	if d.magic == nil && !strings.HasSuffix(p, ".ko") {
+		return decompressor{}, fmt.Errorf("unknown compression of module file %q", p)
+	}
+	return d, nil
+}
+
+// moduleTransformJob returns how to copy the module file of mod into the
+// initramfs
+func (m *Machine) moduleTransformJob(mod *kernelModule) (writerhelper.TransformJob, error) {
+	dest, err := stripCompressionSuffix(m.moduleMachinePath(mod.path))
+	if err != nil {
+		return writerhelper.TransformJob{}, fmt.Errorf("failed to copy module file %q: %w", mod.path, err)
+	}
+
+	// Ensure destination has /usr prefix if running
+	// on merged-usr system.
+	if m.mergedUsr && !strings.HasPrefix(dest, "/usr") {
+		dest = "/usr" + dest
 	}
 
-	var fieldValue []string
-	scanner := bufio.NewScanner(strings.NewReader(string(out)))
-	scanner.Split(bufio.ScanLines)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
+	d, err := moduleDecompressor(mod.path)
+	if err != nil {
+		return writerhelper.TransformJob{}, err
+	}
+
+	// Without a size, as for .ko.gz modules, the module always gets
+	// decompressed into a temporary file first to learn its size
+	return writerhelper.TransformJob{Src: mod.path, Dst: dest, Fn: d.fn, Size: d.size}, nil
+}
+
+// Evaluate any symbolic link, then return the path's directory. Returns an
+// absolute path. Think of it as realpath(1) + dirname(1) in bash.
+func realDir(path string) (string, error) {
+	var p string
+	var err error
+	if p, err = filepath.Abs(path); err != nil {
+		return "", fmt.Errorf("failed to get absolute path for %s: %w", path, err)
+	}
+	if p, err = filepath.EvalSymlinks(p); err != nil {
+		return "", fmt.Errorf("failed to evaluate symlinks for %s: %w", p, err)
+	}
+	return filepath.Dir(p), nil
+}
+
+// resolveIn resolves all symbolic links in the absolute path p as if root was
+// the root directory, so absolute link targets stay within root. The returned
+// path is relative to root.
+func resolveIn(root, p string) (string, error) {
+	resolved := "/"
+	remaining := strings.Split(p, "/")
+
+	for links := 0; len(remaining) > 0; {
+		component := remaining[0]
+		remaining = remaining[1:]
+
+		switch component {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
 			continue
 		}
-		name, value, ok := strings.Cut(line, ":")
-		if !ok {
-			return nil, fmt.Errorf("unexpected modinfo output for module %q: %q", modname, line)
+
+		next := path.Join(resolved, component)
+		info, err := os.Lstat(path.Join(root, next))
+		if err != nil {
+			return "", fmt.Errorf("failed to stat %s: %w", path.Join(root, next), err)
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links resolving %s in %s", p, root)
+		}
+
+		target, err := os.Readlink(path.Join(root, next))
+		if err != nil {
+			return "", fmt.Errorf("failed to read link %s: %w", path.Join(root, next), err)
 		}
-		if strings.TrimSpace(name) == fieldname {
-			fieldValue = append(fieldValue, strings.TrimSpace(value))
+		if path.IsAbs(target) {
+			resolved = "/"
 		}
+		remaining = append(strings.Split(target, "/"), remaining...)
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to scan modinfo output for module %q: %w", modname, err)
+
+	return resolved, nil
+}
+
+// rootPath returns the location of p from the machines root filesystem on the
+// host; the path in the sysroot if one is used, otherwise p itself
+func (m *Machine) rootPath(p string) string {
+	if m.sysroot == "" {
+		return p
+	}
+	return path.Join(m.sysroot, p)
+}
+
+// machinePath is the inverse of rootPath, it returns where the host path p
+// from the machines root filesystem is located inside the machine
+func (m *Machine) machinePath(p string) string {
+	if m.sysroot == "" {
+		return p
 	}
-	return fieldValue, nil
+	return path.Join("/", strings.TrimPrefix(p, m.sysroot))
 }
 
-// Get full path of module
-func getModPath(modname string, kernelRelease string) (string, error) {
-	path, err := getModData(modname, "filename", kernelRelease)
+// machineRealDir is like realDir for a path in the machines root filesystem,
+// the returned directory is a path inside the machine
+func (m *Machine) machineRealDir(p string) (string, error) {
+	if m.sysroot == "" {
+		return realDir(p)
+	}
+
+	resolved, err := resolveIn(m.sysroot, p)
 	if err != nil {
 		return "", err
 	}
-	if len(path) == 0 {
-		return "", fmt.Errorf("could not find path for module %q", modname)
+	return path.Dir(resolved), nil
+}
+
+// moduleNameRegexp matches the kernel module names which can be passed to
+// modprobe in the init script
+var moduleNameRegexp = regexp.MustCompile(`^[\w.:-]+$`)
+
+// moduleBaseDir returns the directory the module directory is located in as
+// <base>/lib/modules/<release>
+func (m *Machine) moduleBaseDir() string {
+	if m.moduleDir == "" {
+		return m.sysroot
 	}
+	return strings.TrimSuffix(path.Dir(m.moduleDir), "/lib/modules")
+}
 
-	return path[0], nil
+// moduleMachinePath returns where the host path p from the module directory
+// is located inside the machine
+func (m *Machine) moduleMachinePath(p string) string {
+	base := m.moduleBaseDir()
+	if base == "" {
+		return p
+	}
+	return path.Join("/", strings.TrimPrefix(p, base))
 }
 
-// Get all dependent module
-func getModDepends(modname string, kernelRelease string) ([]string, error) {
-	deplist, err := getModData(modname, "depends", kernelRelease)
+// kernelImageRelease returns the release of the kernel image at kernelPath, or
+// an empty string if the image format doesn't allow to determine it. Only
+// x86 bzImages are supported.
+func kernelImageRelease(kernelPath string) (_ string, err error) {
+	f, err := os.Open(kernelPath)
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("failed to open kernel %s: %w", kernelPath, err)
 	}
-	var modlist []string
-	for _, v := range deplist {
-		if v != "" {
-			modlist = append(modlist, strings.Split(v, ",")...)
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close kernel %s: %w", kernelPath, closeErr))
 		}
-	}
+	}()
 
-	// Busybox expects a full dependency list for each module rather than just
-	// direct dependencies, so recurse the module dependency tree:
-	// https://github.com/mirror/busybox/blob/1dd2685dcc735496d7adde87ac60b9434ed4a04c/modutils/modprobe.c#L46-L49
-	var sublist []string
-	for _, mod := range modlist {
-		deps, err := getModDepends(mod, kernelRelease)
-		if err != nil {
-			return nil, fmt.Errorf("get dependencies for module %q: %w", mod, err)
-		}
-		sublist = append(sublist, deps...)
+	header := make([]byte, 64*1024)
+	n, err := io.ReadFull(f, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", fmt.Errorf("failed to read kernel %s: %w", kernelPath, err)
 	}
+	header = header[:n]
 
-	modlist = append(modlist, sublist...)
-
-	return modlist, nil
+	// The x86 boot protocol setup header starts with "HdrS" at 0x202 and
+	// has a pointer to the kernel version string (relative to 0x200) at
+	// 0x20e: https://docs.kernel.org/arch/x86/boot.html
+	if len(header) < 0x210 || string(header[0x202:0x206]) != "HdrS" {
+		return "", nil
+	}
+	offset := 0x200 + (int(header[0x20e]) | int(header[0x20f])<<8)
+	if offset >= len(header) {
+		return "", nil
+	}
+	version, _, _ := bytes.Cut(header[offset:], []byte{0})
+	release, _, _ := strings.Cut(string(version), " ")
+	return release, nil
 }
 
-var suffixes = map[string]writerhelper.Transformer{
-	".ko":     NullDecompressor,
-	".ko.gz":  GzipDecompressor,
-	".ko.xz":  XzDecompressor,
-	".ko.zst": ZstdDecompressor,
-}
+// checkKernel verifies the kernel and the module directory used by the
+// backend belong together and provide the modules the backend needs
+func (m *Machine) checkKernel() error {
+	if m.moduleDir != "" && !strings.HasSuffix(path.Dir(m.moduleDir), "/lib/modules") {
+		return fmt.Errorf("module directory %s is not a lib/modules/<release> directory", m.moduleDir)
+	}
 
-func (m *Machine) copyModules(w *writerhelper.WriterHelper, modname string, copiedModules map[string]bool) error {
+	kernelPath, err := m.backend.KernelPath()
+	if err != nil {
+		return fmt.Errorf("failed to get kernel path: %w", err)
+	}
+	moddir, err := m.backend.ModulePath()
+	if err != nil {
+		return fmt.Errorf("failed to get kernel module directory: %w", err)
+	}
 	release, err := m.backend.KernelRelease()
 	if err != nil {
 		return fmt.Errorf("failed to get kernel release: %w", err)
 	}
-	modpath, err := getModPath(modname, release)
+
+	imageRelease, err := kernelImageRelease(kernelPath)
 	if err != nil {
-		return fmt.Errorf("kernel module %q not found for kernel release %q: %w", modname, release, err)
+		return err
+	}
+	if imageRelease != "" && imageRelease != release {
+		return fmt.Errorf("kernel %s is release %s, but the modules in %s are for release %s",
+			kernelPath, imageRelease, moddir, release)
 	}
 
-	if modpath == "(builtin)" || copiedModules[modname] {
-		return nil
+	db, err := m.kernelModuleDB(moddir)
+	if err != nil {
+		return fmt.Errorf("failed to load kernel modules of release %s: %w", release, err)
+	}
+	for _, mod := range m.backend.InitModules() {
+		if _, err := db.lookup(mod); err != nil {
+			return fmt.Errorf("kernel module %s needed by the %s backend is neither built into kernel release %s nor available in %s: %w",
+				mod, m.backend.Name(), release, moddir, err)
+		}
+	}
+	for _, mod := range m.modules {
+		if !moduleNameRegexp.MatchString(mod) {
+			return fmt.Errorf("invalid kernel module name %q", mod)
+		}
+		if _, err := db.lookup(mod); err != nil {
+			return fmt.Errorf("kernel module %s is neither built into kernel release %s nor available in %s: %w",
+				mod, release, moddir, err)
+		}
 	}
 
-	found := false
-	for suffix, fn := range suffixes {
-		if strings.HasSuffix(modpath, suffix) {
-			if _, err := os.Stat(modpath); err != nil {
-				return fmt.Errorf("failed to stat module file %q: %w", modpath, err)
-			}
+	return nil
+}
 
-			// The suffix is the complete thing - ".ko.foobar"
-			// Reinstate the required ".ko" part, after trimming.
-			dest := strings.TrimSuffix(modpath, suffix) + ".ko"
+// kernelConfig returns the options the kernel of the machine was configured
+// with, or nil if its config can't be found. The config is looked for next to
+// the kernel image and in /boot of the machines root filesystem.
+func (m *Machine) kernelConfig() (map[string]string, error) {
+	kernelPath, err := m.backend.KernelPath()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kernel path: %w", err)
+	}
+	release, err := m.backend.KernelRelease()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get kernel release: %w", err)
+	}
+
+	for _, p := range []string{
+		path.Join(path.Dir(kernelPath), "config-"+release),
+		m.rootPath("/boot/config-" + release),
+	} {
+		data, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read kernel config: %w", err)
+		}
 
-			// Ensure destination has /usr prefix if running
-			// on merged-usr system.
-			if m.mergedUsr && !strings.HasPrefix(dest, "/usr") {
-				dest = "/usr" + dest
+		config := map[string]string{}
+		for _, line := range strings.Split(string(data), "\n") {
+			if key, value, ok := strings.Cut(line, "="); ok && !strings.HasPrefix(key, "#") {
+				config[key] = value
 			}
+		}
+		return config, nil
+	}
+
+	return nil, nil
+}
+
+// initrdCompression returns the compression to use for the initramfs,
+// checking the kernel supports it if its config is available
+func (m *Machine) initrdCompression() (Compression, error) {
+	if m.compression == CompressionNone {
+		return CompressionNone, nil
+	}
+
+	config, err := m.kernelConfig()
+	if err != nil {
+		return "", err
+	}
 
-			if err := w.TransformFileTo(modpath, dest, fn); err != nil {
-				return fmt.Errorf("failed to transform module file %q: %w", modpath, err)
+	if m.compression == CompressionAuto {
+		// gzip is supported by virtually every kernel
+		if config == nil {
+			return CompressionGzip, nil
+		}
+		for _, c := range compressionKernelConfig {
+			if config[c.option] == "y" {
+				return c.compression, nil
 			}
-			found = true
-			break
 		}
+		return CompressionNone, nil
 	}
-	if !found {
-		return errors.New("kernel module extension/suffix unknown")
+
+	for _, c := range compressionKernelConfig {
+		if c.compression != m.compression {
+			continue
+		}
+		if config != nil && config[c.option] != "y" {
+			return "", fmt.Errorf("kernel doesn't support %s compressed initramfs (%s isn't set)", c.compression, c.option)
+		}
+		return c.compression, nil
 	}
 
-	copiedModules[modname] = true
+	return "", fmt.Errorf("unknown initramfs compression %q", m.compression)
+}
 
-	deplist, err := getModDepends(modname, release)
-	if err != nil {
-		return fmt.Errorf("failed to get dependencies for kernel module %q: %w", modname, err)
+// kernelModuleDB returns the module database of the kernel module directory
+// moddir. It is only loaded once per run, as all of the initramfs is generated
+// from the same modules.
+func (m *Machine) kernelModuleDB(moddir string) (*moduleDB, error) {
+	if m.moduleDB == nil || m.moduleDB.dir != moddir {
+		db, err := loadModuleDB(moddir)
+		if err != nil {
+			return nil, err
+		}
+		m.moduleDB = db
 	}
-	for _, mod := range deplist {
-		if err := m.copyModules(w, mod, copiedModules); err != nil {
-			return err
+	return m.moduleDB, nil
+}
+
+// addModuleVolume shares the module directory set with SetKernel read-only
+// with the machine at /lib/modules/<release>, where the root filesystem of the
+// machine has a directory to mount it on
+func (m *Machine) addModuleVolume() error {
+	if m.moduleDir == "" {
+		return nil
+	}
+
+	machineDirectory := path.Join("/lib/modules", path.Base(m.moduleDir))
+	if m.mergedUsr {
+		machineDirectory = "/usr" + machineDirectory
+	}
+	if m.rootPath(machineDirectory) == m.moduleDir {
+		return nil
+	}
+
+	info, err := os.Stat(m.rootPath(machineDirectory))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to check %s: %w", m.rootPath(machineDirectory), err)
+		}
+		if !m.quiet {
+			fmt.Printf("Not sharing module directory %s: %s doesn't exist in the machine\n", m.moduleDir, machineDirectory)
 		}
+		return nil
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("failed to share module directory %s: %s is not a directory", m.moduleDir, machineDirectory)
 	}
 
+	m.AddVolumeWithOptions(m.moduleDir, machineDirectory, VolumeOptions{ReadOnly: true})
 	return nil
 }
 
-// Evaluate any symbolic link, then return the path's directory. Returns an
-// absolute path. Think of it as realpath(1) + dirname(1) in bash.
-func realDir(path string) (string, error) {
-	var p string
-	var err error
-	if p, err = filepath.Abs(path); err != nil {
-		return "", fmt.Errorf("failed to get absolute path for %s: %w", path, err)
+// setupVirtiofs checks whether the volumes can be shared using virtiofs and if
+// so sets up the machine to do so
+func (m *Machine) setupVirtiofs() error {
+	virtiofsd, err := findVirtiofsd()
+	if err != nil {
+		return err
 	}
-	if p, err = filepath.EvalSymlinks(p); err != nil {
-		return "", fmt.Errorf("failed to evaluate symlinks for %s: %w", p, err)
+
+	moddir, err := m.backend.ModulePath()
+	if err != nil {
+		return fmt.Errorf("failed to get kernel module directory: %w", err)
 	}
-	return filepath.Dir(p), nil
+	db, err := m.kernelModuleDB(moddir)
+	if err != nil {
+		return fmt.Errorf("failed to load kernel modules: %w", err)
+	}
+	if _, err := db.lookup("virtiofs"); err != nil {
+		return fmt.Errorf("kernel lacks virtiofs support: %w", err)
+	}
+
+	m.virtiofsd = virtiofsd
+	return nil
+}
+
+// lookPath searches for the executable file in the usual binary directories of
+// the machines root filesystem and returns its path inside the machine
+func (m *Machine) lookPath(file string) (string, error) {
+	if m.sysroot == "" {
+		path, err := exec.LookPath(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to find %s: %w", file, err)
+		}
+		return path, nil
+	}
+
+	for _, dir := range []string{"/usr/bin", "/usr/sbin", "/bin", "/sbin"} {
+		p := path.Join(dir, file)
+		if info, err := os.Stat(m.rootPath(p)); err == nil && info.Mode().IsRegular() && info.Mode()&0111 != 0 {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("failed to find %s in sysroot %s", file, m.sysroot)
 }
 
 // addVolumeIfExists adds volumePath as a machine volume if it exists on the host.
@@ -189,32 +461,33 @@ func realDir(path string) (string, error) {
 // error and returns false, nil. If the path exists but is not a directory, or
 // cannot be checked, it returns false and an error.
 func (m *Machine) addVolumeIfExists(volumePath string) (bool, error) {
-	stat, err := os.Stat(volumePath)
+	hostPath := m.rootPath(volumePath)
+	stat, err := os.Stat(hostPath)
 
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return false, nil
 		}
 
-		return false, fmt.Errorf("failed to check %q: %w", volumePath, err)
+		return false, fmt.Errorf("failed to check %q: %w", hostPath, err)
 	}
 
 	if !stat.IsDir() {
-		return false, fmt.Errorf("failed to add volume %q: not a directory", volumePath)
+		return false, fmt.Errorf("failed to add volume %q: not a directory", hostPath)
 	}
 
-	m.AddVolume(volumePath)
+	m.AddVolumeAt(hostPath, volumePath)
 	return true, nil
 }
 
 func (m *Machine) addVolumesWithGlob(pattern string) error {
-	matches, err := filepath.Glob(pattern)
+	matches, err := filepath.Glob(m.rootPath(pattern))
 	if err != nil {
 		return fmt.Errorf("glob %s: %w", pattern, err)
 	}
 
 	for _, volumePath := range matches {
-		if _, err := m.addVolumeIfExists(volumePath); err != nil {
+		if _, err := m.addVolumeIfExists(m.machinePath(volumePath)); err != nil {
 			return err
 		}
 	}
@@ -225,18 +498,31 @@ func (m *Machine) addVolumesWithGlob(pattern string) error {
 type Arch string
 
 const (
-	Amd64 Arch = "amd64"
-	Arm64 Arch = "arm64"
+	Amd64   Arch = "amd64"
+	Arm64   Arch = "arm64"
+	Armhf   Arch = "armhf"
+	I386    Arch = "i386"
+	Ppc64el Arch = "ppc64el"
+	Riscv64 Arch = "riscv64"
 )
 
+// Maps GOARCH to the machine architecture
 var archMap = map[string]Arch{
-	"amd64": Amd64,
-	"arm64": Arm64,
+	"amd64":   Amd64,
+	"arm64":   Arm64,
+	"arm":     Armhf,
+	"386":     I386,
+	"ppc64le": Ppc64el,
+	"riscv64": Riscv64,
 }
 
 var archDynamicLinker = map[Arch]string{
-	Amd64: "/lib64/ld-linux-x86-64.so.2",
-	Arm64: "/lib/ld-linux-aarch64.so.1",
+	Amd64:   "/lib64/ld-linux-x86-64.so.2",
+	Arm64:   "/lib/ld-linux-aarch64.so.1",
+	Armhf:   "/lib/ld-linux-armhf.so.3",
+	I386:    "/lib/ld-linux.so.2",
+	Ppc64el: "/lib64/ld64.so.2",
+	Riscv64: "/lib/ld-linux-riscv64-lp64d.so.1",
 }
 
 type mountPoint struct {
@@ -244,6 +530,92 @@ type mountPoint struct {
 	machineDirectory string
 	label            string
 	static           bool
+	options          VolumeOptions
+}
+
+// fileMount is a single file of the host which is copied into the initramfs
+// and bind mounted over machineFile before the command runs
+type fileMount struct {
+	hostFile    string
+	machineFile string
+}
+
+// initrdFile is an entry added to the initramfs by the user of the machine
+type initrdFile struct {
+	path  string
+	write func(w *writerhelper.WriterHelper) error
+}
+
+// Directory of the initramfs holding the files of file volumes
+const fileMountDirectory = "/fakemachine/files"
+
+// VolumeOptions are the options of a volume shared with the machine
+type VolumeOptions struct {
+	// ReadOnly prevents the machine from modifying the volume
+	ReadOnly bool
+	// Cache is the 9p cache mode of the volume (none, loose, fscache, mmap
+	// or readahead), defaults to loose. Use none for volumes the host
+	// modifies while the machine runs to avoid stale reads.
+	Cache string
+	// Msize is the maximum 9p message size in bytes, defaults to 262144
+	Msize int
+	// Access is the 9p access mode of the volume (user, any, client or a
+	// numeric user id), defaults to the kernels default
+	Access string
+}
+
+// validate checks the options for values the machine can't mount with
+func (o VolumeOptions) validate() error {
+	switch o.Cache {
+	case "", "none", "loose", "fscache", "mmap", "readahead":
+	default:
+		return fmt.Errorf("unknown cache mode %q", o.Cache)
+	}
+
+	if o.Msize < 0 {
+		return fmt.Errorf("invalid msize %d", o.Msize)
+	}
+
+	switch o.Access {
+	case "", "user", "any", "client":
+	default:
+		if _, err := strconv.ParseUint(o.Access, 10, 32); err != nil {
+			return fmt.Errorf("unknown access mode %q", o.Access)
+		}
+	}
+
+	return nil
+}
+
+// Network is the kind of network connection of the machine
+type Network string
+
+const (
+	// NetworkUser connects the machine to the network of the host via
+	// user mode networking (the default)
+	NetworkUser Network = "user"
+	// NetworkNone leaves the machine without network connection
+	NetworkNone Network = "none"
+)
+
+// VolumeSharing is the way volumes of the host are shared with the machine
+type VolumeSharing string
+
+const (
+	// Sharing9p shares volumes using the 9p protocol over virtio (the
+	// default)
+	Sharing9p VolumeSharing = "9p"
+	// SharingVirtiofs shares volumes using virtiofs, which is considerably
+	// faster than 9p. It falls back to 9p if virtiofsd isn't available on
+	// the host or the kernel lacks virtiofs support.
+	SharingVirtiofs VolumeSharing = "virtiofs"
+)
+
+type portForward struct {
+	proto     string
+	hostAddr  string
+	hostPort  int
+	guestPort int
 }
 
 type image struct {
@@ -252,18 +624,46 @@ type image struct {
 }
 
 type Machine struct {
-	arch       Arch
-	backend    backend
-	mounts     []mountPoint
-	count      int
-	images     []image
-	memory     int
-	numcpus    int
-	sectorSize int
-	showBoot   bool
-	quiet      bool
-	mergedUsr  bool
-	Environ    []string
+	arch        Arch
+	sysroot     string
+	kernelPath  string
+	moduleDir   string
+	backend     backend
+	kernelArgs  []string
+	modules     []string
+	network     Network
+	forwards    []portForward
+	sharing     VolumeSharing
+	compression Compression
+	mounts      []mountPoint
+	mountErrors []error
+	fileMounts  []fileMount
+	initrd      []initrdFile
+	count       int
+	images      []image
+	memory      int
+	numcpus     int
+	sectorSize  int
+	showBoot    bool
+	quiet       bool
+	mergedUsr   bool
+	Environ     []string
+
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	// socket the session agent port is connected to, only set while a
+	// session is starting or running
+	agentSocket string
+
+	// virtiofsd serving the volumes, only set while the machine runs with
+	// volumes shared using virtiofs
+	virtiofsd string
+
+	// moduleDB of the kernel module directory, loaded once per run by
+	// kernelModuleDB
+	moduleDB *moduleDB
 
 	scratchsize int64
 	scratchpath string
@@ -279,14 +679,55 @@ func NewMachine() (*Machine, error) {
 
 // Create a new machine object
 func NewMachineWithBackend(backendName string) (*Machine, error) {
+	return NewMachineWithOptions(MachineOptions{Backend: backendName})
+}
+
+// MachineOptions describes the machine created by NewMachineWithOptions
+type MachineOptions struct {
+	// Backend is the name of the backend to use, defaults to "auto"
+	Backend string
+
+	// Arch is the architecture of the machine, defaults to the architecture
+	// of the host. Foreign architectures are emulated and need a Sysroot.
+	Arch Arch
+
+	// Sysroot is the root filesystem the machine is based on instead of the
+	// one of the host. The kernel, kernel modules, /usr and the libraries and
+	// configuration copied into the initrd are all taken from it.
+	Sysroot string
+}
+
+// Create a new machine object with the given options
+func NewMachineWithOptions(options MachineOptions) (*Machine, error) {
 	var err error
-	m := &Machine{memory: 2048, numcpus: runtime.NumCPU(), sectorSize: 512}
+	m := &Machine{memory: 2048, numcpus: runtime.NumCPU(), sectorSize: 512, network: NetworkUser, sharing: Sharing9p, compression: CompressionNone}
 
-	var ok bool
-	if m.arch, ok = archMap[runtime.GOARCH]; !ok {
+	hostArch, ok := archMap[runtime.GOARCH]
+	if !ok {
 		return nil, fmt.Errorf("unsupported arch %s", runtime.GOARCH)
 	}
 
+	m.arch = options.Arch
+	if m.arch == "" {
+		m.arch = hostArch
+	}
+	if _, ok := archDynamicLinker[m.arch]; !ok {
+		return nil, fmt.Errorf("unsupported arch %s", m.arch)
+	}
+
+	if options.Sysroot != "" {
+		m.sysroot, err = filepath.Abs(options.Sysroot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get absolute path for sysroot %s: %w", options.Sysroot, err)
+		}
+	} else if m.arch != hostArch {
+		return nil, fmt.Errorf("a sysroot is needed for %s machines on a %s host", m.arch, hostArch)
+	}
+
+	backendName := options.Backend
+	if backendName == "" {
+		backendName = "auto"
+	}
 	m.backend, err = newBackend(backendName, m)
 	if err != nil {
 		return nil, err
@@ -295,8 +736,8 @@ func NewMachineWithBackend(backendName string) (*Machine, error) {
 	// usr is mounted by specific label via /init
 	m.addStaticVolume("/usr", "usr")
 
-	// check if the host is a merged-usr system
-	m.mergedUsr, err = mergedUsrSystem()
+	// check if the machines root filesystem is a merged-usr system
+	m.mergedUsr, err = mergedUsrSystem(m.sysroot)
 	if err != nil {
 		return nil, fmt.Errorf("failed to check if the host is a merged-usr system: %w", err)
 	}
@@ -359,6 +800,9 @@ busybox mount -t sysfs none /sys
 {{ range $m := .Backend.InitModules }}
 busybox modprobe {{ $m }}
 {{ end }}
+{{ range $m := ProbedModules .Machine }}
+busybox modprobe {{ $m }}
+{{ end }}
 
 # mount static volumes
 {{ range $point := StaticVolumes .Machine }}
@@ -388,7 +832,32 @@ Name=ethernet0
 `
 
 const commandWrapper = `#!/bin/sh
-/lib/systemd/systemd-networkd-wait-online -q --interface=ethernet0
+%[2]s
+%[3]s
+%[4]s
+# The command runs in a subshell so its result is recorded even if it exits
+echo "started $(cut -d ' ' -f 1 /proc/uptime)" >> /run/fakemachine/result
+(
+%[1]s
+)
+status=$?
+echo "finished $(cut -d ' ' -f 1 /proc/uptime)" >> /run/fakemachine/result
+echo "oom_kill $(sed -n 's/^oom_kill //p' /sys/fs/cgroup$(cut -d : -f 3 /proc/self/cgroup)/memory.events 2>/dev/null)" >> /run/fakemachine/result
+echo "exit $status" >> /run/fakemachine/result
+`
+
+// Bind mounts a file volume over its machine path, which is either in the
+// initramfs or an existing file on a volume, see writeFileMountTargets
+const fileMountCommand = `if [ ! -e %[2]s ] || ! mount --bind %[1]s %[2]s; then
+  echo "ERROR: Failed to mount file volume at" %[2]s
+  echo "failed file-volume" >> /run/fakemachine/result
+  exit 1
+fi
+`
+
+// Waits for the network to be set up before the wrapper script runs the
+// command, unless networking is disabled
+const networkWait = `/lib/systemd/systemd-networkd-wait-online -q --interface=ethernet0
 if [ $? != 0 ]; then
   echo "WARNING: Network setup failed"
   echo "== Journal =="
@@ -396,24 +865,27 @@ if [ $? != 0 ]; then
   echo "== networkd =="
   networkctl status
   networkctl list
-  echo 1 > /run/fakemachine/result
+  echo "failed network" >> /run/fakemachine/result
   exit
 fi
-
-%[1]s
-echo $? > /run/fakemachine/result
 `
 
+// Redirects the standard streams of the wrapper script to the devices
+// returned by the backends JobStreamDevices() once udev has created them
+const streamsRedirect = `udevadm settle
+exec <%[1]s >%[2]s 2>%[3]s`
+
 // The line 'Environment=%[2]s' is used for environment variables optionally
-// configured using Machine.SetEnviron()
+// configured using Machine.SetEnviron(), %[3]s are the units needed for
+// networking
 const serviceTemplate = `
 [Unit]
 Description=fakemachine runner
 Conflicts=shutdown.target
 Before=shutdown.target
 Requires=basic.target
-Wants=systemd-resolved.service binfmt-support.service systemd-networkd.service
-After=basic.target systemd-resolved.service binfmt-support.service systemd-networkd.service
+Wants=systemd-resolved.service binfmt-support.service %[3]s
+After=basic.target systemd-resolved.service binfmt-support.service %[3]s
 OnFailure=poweroff.target
 
 [Service]
@@ -431,6 +903,7 @@ KillMode=process
 IgnoreSIGPIPE=no
 SendSIGHUP=yes
 LimitNOFILE=4096
+MemoryAccounting=yes
 `
 
 // helper function to generate a mount command for a given mountpoint
@@ -459,10 +932,17 @@ func tmplStaticVolumes(m Machine) []mountPoint {
 	return mounts
 }
 
+// helper function to return the kernel modules to probe on boot, since the
+// modules variable is unexported
+func tmplProbedModules(m Machine) []string {
+	return m.modules
+}
+
 func executeInitScriptTemplate(m *Machine, b backend) ([]byte, error) {
 	helperFuncs := template.FuncMap{
 		"MountVolume":   tmplMountVolume,
 		"StaticVolumes": tmplStaticVolumes,
+		"ProbedModules": tmplProbedModules,
 	}
 
 	type templateVars struct {
@@ -480,23 +960,116 @@ func executeInitScriptTemplate(m *Machine, b backend) ([]byte, error) {
 }
 
 func (m *Machine) addStaticVolume(directory, label string) {
-	m.mounts = append(m.mounts, mountPoint{directory, directory, label, true})
+	m.mounts = append(m.mounts, mountPoint{m.rootPath(directory), directory, label, true, VolumeOptions{}})
 }
 
-// AddVolumeAt mounts hostDirectory from the host at machineDirectory in the
-// fake machine
-func (m *Machine) AddVolumeAt(hostDirectory, machineDirectory string) {
+// AddVolumeWithOptions mounts hostDirectory from the host at
+// machineDirectory in the fake machine using the given options. Adding the
+// same volume again with different options makes the machine fail to start.
+func (m *Machine) AddVolumeWithOptions(hostDirectory, machineDirectory string, options VolumeOptions) {
 	label := fmt.Sprintf("virtfs-%d", m.count)
 	for _, mount := range m.mounts {
 		if mount.hostDirectory == hostDirectory && mount.machineDirectory == machineDirectory {
-			// Do not need to add already existing mount
+			// Do not need to add already existing mount, but don't silently
+			// drop options such as ReadOnly either
+			if mount.options != options {
+				m.mountErrors = append(m.mountErrors,
+					fmt.Errorf("couldn't mount %s inside machine: already added at %s with different options", hostDirectory, machineDirectory))
+			}
 			return
 		}
 	}
-	m.mounts = append(m.mounts, mountPoint{hostDirectory, machineDirectory, label, false})
+	m.mounts = append(m.mounts, mountPoint{hostDirectory, machineDirectory, label, false, options})
 	m.count = m.count + 1
 }
 
+// AddVolumeAt mounts hostDirectory from the host at machineDirectory in the
+// fake machine
+func (m *Machine) AddVolumeAt(hostDirectory, machineDirectory string) {
+	m.AddVolumeWithOptions(hostDirectory, machineDirectory, VolumeOptions{})
+}
+
+// AddFileVolumeAt makes the regular file hostFile of the host available at
+// machineFile in the fake machine, without sharing its parent directory. The
+// file is copied when the machine starts, so changes on either side aren't
+// visible to the other. A missing machineFile is created in the initramfs,
+// unless it is on a volume: creating it there would change the host, so it
+// has to exist, otherwise the run fails in PhaseFileVolume before the command
+// starts. Sockets, e.g. of an SSH agent, can't be added as unix sockets can't
+// be connected to across the shares of the volumes.
+func (m *Machine) AddFileVolumeAt(hostFile, machineFile string) {
+	m.fileMounts = append(m.fileMounts, fileMount{hostFile, machineFile})
+}
+
+// addInitrdFile queues an entry to be written to the initramfs at dst
+func (m *Machine) addInitrdFile(dst string, write func(w *writerhelper.WriterHelper, dst string) error) error {
+	if !path.IsAbs(dst) {
+		return fmt.Errorf("initramfs path %s is not absolute", dst)
+	}
+	dst = path.Clean(dst)
+
+	m.initrd = append(m.initrd, initrdFile{dst, func(w *writerhelper.WriterHelper) error {
+		return write(w, dst)
+	}})
+	return nil
+}
+
+// AddFile copies the file src of the host into the initramfs of the machine
+// at dst. Files in the initramfs are hidden by volumes mounted over them and
+// must not collide with files fakemachine generates itself, which fails the
+// run.
+func (m *Machine) AddFile(src, dst string) error {
+	return m.addInitrdFile(dst, func(w *writerhelper.WriterHelper, dst string) error {
+		return w.CopyFileTo(src, dst)
+	})
+}
+
+// AddFileContent writes content into the initramfs of the machine at dst with
+// the permissions mode, see AddFile.
+func (m *Machine) AddFileContent(dst string, content []byte, mode os.FileMode) error {
+	return m.addInitrdFile(dst, func(w *writerhelper.WriterHelper, dst string) error {
+		return w.WriteFileRaw(dst, content, mode)
+	})
+}
+
+// AddSymlink creates a symlink at link pointing to target in the initramfs of
+// the machine, see AddFile.
+func (m *Machine) AddSymlink(target, link string) error {
+	return m.addInitrdFile(link, func(w *writerhelper.WriterHelper, link string) error {
+		return w.WriteSymlink(target, link, 0777)
+	})
+}
+
+// AddTree copies the directory tree src of the host into the initramfs of the
+// machine at dst, preserving symlinks, hardlinks, FIFOs and devices, see
+// AddFile.
+func (m *Machine) AddTree(src, dst string) error {
+	return m.addInitrdFile(dst, func(w *writerhelper.WriterHelper, dst string) error {
+		return w.CopyTreeTo(src, dst)
+	})
+}
+
+// writeInitrdFiles writes the entries added by the user of the machine to the
+// initramfs, after everything fakemachine generates itself
+func (m *Machine) writeInitrdFiles(w *writerhelper.WriterHelper) error {
+	for _, f := range m.initrd {
+		if w.Contains(f.path) {
+			return fmt.Errorf("failed to add %s to initramfs: collides with an existing file", f.path)
+		}
+		for dir := path.Dir(f.path); dir != "/"; dir = path.Dir(dir) {
+			if w.Contains(dir) && !w.IsDirectory(dir) {
+				return fmt.Errorf("failed to add %s to initramfs: %s is not a directory", f.path, dir)
+			}
+		}
+
+		if err := f.write(w); err != nil {
+			return fmt.Errorf("failed to add %s to initramfs: %w", f.path, err)
+		}
+	}
+
+	return nil
+}
+
 // AddVolume mounts directory from the host at the same location in the
 // fake machine
 func (m *Machine) AddVolume(directory string) {
@@ -587,6 +1160,151 @@ func (m *Machine) SetSectorSize(sectorSize int) {
 	m.sectorSize = sectorSize
 }
 
+// SetKernel sets the kernel image booted by the machine and the directory its
+// modules are taken from, both paths on the host. Either can be empty to
+// detect it automatically. The module directory has to be laid out like
+// /lib/modules/<release> as the kernel release is taken from its name; if
+// only a kernel is given its modules are looked for by its release where it
+// can be determined. A module directory given is shared read-only with the
+// machine at /lib/modules/<release>, so modules which aren't part of the
+// initramfs can be loaded as well, if that directory exists in the root
+// filesystem of the machine; creating it would modify the host.
+func (m *Machine) SetKernel(kernelPath, moduleDir string) {
+	m.kernelPath = kernelPath
+	m.moduleDir = ""
+	if moduleDir != "" {
+		if abs, err := filepath.Abs(moduleDir); err == nil {
+			moduleDir = abs
+		}
+		m.moduleDir = path.Clean(moduleDir)
+	}
+}
+
+// AppendKernelArgs adds arguments to the kernel command line of the machine.
+// Arguments the machine needs to work (e.g. console= and systemd.unit=)
+// can't be overridden and return an error, as do arguments containing
+// whitespace. Changing the init of the machine with init= or rdinit=, or
+// passing arguments to it after --, isn't possible either.
+func (m *Machine) AppendKernelArgs(args []string) error {
+	reserved := map[string]bool{"init": true, "rdinit": true, "--": true}
+	for _, arg := range m.backend.KernelArgs() {
+		key, _, _ := strings.Cut(arg, "=")
+		reserved[key] = true
+	}
+
+	for _, arg := range args {
+		if arg == "" || strings.ContainsFunc(arg, unicode.IsSpace) {
+			return fmt.Errorf("invalid kernel argument %q", arg)
+		}
+
+		key, _, _ := strings.Cut(arg, "=")
+		if reserved[key] {
+			return fmt.Errorf("kernel argument %q overrides %s which is required by fakemachine", arg, key)
+		}
+	}
+
+	m.kernelArgs = append(m.kernelArgs, args...)
+	return nil
+}
+
+// AddKernelModules adds the kernel modules and their dependencies to the
+// initramfs and loads them during boot, before any volume gets mounted, so
+// they are available even if the module directory isn't part of the volumes of
+// the machine. They are always loaded from the initramfs, as the volumes hide
+// its module directory once mounted. Missing modules are reported when the
+// machine starts.
+func (m *Machine) AddKernelModules(modules ...string) {
+	m.modules = append(m.modules, modules...)
+}
+
+// initrdModules returns all kernel modules to add to the initramfs
+func (m *Machine) initrdModules() []string {
+	return append(m.backend.InitModules(), m.modules...)
+}
+
+// SetNetwork sets the network connection of the machine. Defaults to
+// NetworkUser; with NetworkNone the machine has no network interface and
+// doesn't wait for the network to come up before running the command.
+func (m *Machine) SetNetwork(network Network) error {
+	if network != NetworkUser && network != NetworkNone {
+		return fmt.Errorf("invalid network %q", network)
+	}
+
+	m.network = network
+	return nil
+}
+
+// AddPortForward forwards connections to hostPort on hostAddr of the host to
+// guestPort of the machine, proto is either "tcp" or "udp". An empty hostAddr
+// listens on all addresses of the host. If hostPort is 0 a free port is
+// picked; the host port used is returned in any case. Forwarding ports
+// requires user mode networking.
+func (m *Machine) AddPortForward(proto, hostAddr string, hostPort, guestPort int) (int, error) {
+	if proto != "tcp" && proto != "udp" {
+		return 0, fmt.Errorf("invalid port forward protocol %q", proto)
+	}
+	if hostPort < 0 || hostPort > 65535 {
+		return 0, fmt.Errorf("invalid host port %d", hostPort)
+	}
+	if guestPort < 1 || guestPort > 65535 {
+		return 0, fmt.Errorf("invalid guest port %d", guestPort)
+	}
+	if strings.ContainsAny(hostAddr, ":,") {
+		return 0, fmt.Errorf("invalid host address %q", hostAddr)
+	}
+
+	if hostPort == 0 {
+		port, err := freePort(proto, hostAddr)
+		if err != nil {
+			return 0, err
+		}
+		hostPort = port
+	}
+
+	m.forwards = append(m.forwards, portForward{
+		proto:     proto,
+		hostAddr:  hostAddr,
+		hostPort:  hostPort,
+		guestPort: guestPort,
+	})
+	return hostPort, nil
+}
+
+// freePort finds a port on addr which is currently free for proto. The port
+// isn't reserved, so there is a small window for something else to take it
+// before the machine binds it.
+func freePort(proto, addr string) (int, error) {
+	hostport := net.JoinHostPort(addr, "0")
+
+	if proto == "udp" {
+		conn, err := net.ListenPacket(proto, hostport)
+		if err != nil {
+			return 0, fmt.Errorf("failed to find free %s port: %w", proto, err)
+		}
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		return port, conn.Close()
+	}
+
+	listener, err := net.Listen(proto, hostport)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find free %s port: %w", proto, err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	return port, listener.Close()
+}
+
+// SetVolumeSharing sets how volumes are shared with the machine, see
+// VolumeSharing. Defaults to Sharing9p.
+func (m *Machine) SetVolumeSharing(sharing VolumeSharing) {
+	m.sharing = sharing
+}
+
+// SetInitrdCompression sets how the initramfs of the machine is compressed,
+// see Compression. Defaults to CompressionNone.
+func (m *Machine) SetInitrdCompression(compression Compression) {
+	m.compression = compression
+}
+
 // SetShowBoot sets whether to show boot/console messages from the fakemachine.
 func (m *Machine) SetShowBoot(showBoot bool) {
 	m.showBoot = showBoot
@@ -599,6 +1317,38 @@ func (m *Machine) SetQuiet(quiet bool) {
 	m.quiet = quiet
 }
 
+// SetStdin sets the reader the command reads its standard input from. If nil
+// (the default) and none of the other streams are redirected, the command
+// reads from the terminal fakemachine is running on; otherwise its standard
+// input is empty.
+//
+// Reading from stdin carries on in the background for as long as stdin blocks,
+// even after the machine has exited.
+func (m *Machine) SetStdin(stdin io.Reader) {
+	m.stdin = stdin
+}
+
+// SetStdout sets the writer the standard output of the command is written to.
+// If nil (the default), it is written to os.Stdout. Setting any stream
+// separates the commands standard output and error, which otherwise are both
+// written to os.Stdout via the machines console.
+func (m *Machine) SetStdout(stdout io.Writer) {
+	m.stdout = stdout
+}
+
+// SetStderr sets the writer the standard error of the command is written to.
+// If nil (the default), it is written to os.Stderr if any stream is
+// redirected, see SetStdout.
+func (m *Machine) SetStderr(stderr io.Writer) {
+	m.stderr = stderr
+}
+
+// redirectStreams returns whether any standard stream of the command is
+// redirected by the caller
+func (m *Machine) redirectStreams() bool {
+	return m.stdin != nil || m.stdout != nil || m.stderr != nil
+}
+
 // SetScratch sets the size and location of on-disk scratch space to allocate
 // (sparsely) for /scratch. If not set /scratch will be backed by memory. If
 // Path is "" then the working directory is used as a default storage location
@@ -619,6 +1369,9 @@ func (m Machine) generateFstab(w *writerhelper.WriterHelper, backend backend) er
 
 	for _, point := range m.mounts {
 		fstype, options := backend.MountParameters(point)
+		if len(options) == 0 {
+			options = []string{"defaults"}
+		}
 		fstab = append(fstab,
 			fmt.Sprintf("%s %s %s %s 0 0",
 				point.label, point.machineDirectory, fstype, strings.Join(options, ",")))
@@ -632,54 +1385,37 @@ func (m Machine) generateFstab(w *writerhelper.WriterHelper, backend backend) er
 	return nil
 }
 
+// stripCompressionSuffix returns the name of the module file once
+// decompressed, dropping the compression suffix following ".ko"
 func stripCompressionSuffix(module string) (string, error) {
-	for suffix := range suffixes {
-		// The suffix is the complete thing - ".ko.foobar"
-		// Reinstate the required ".ko" part, after trimming.
-		if trimmed, ok := strings.CutSuffix(module, suffix); ok {
-			return trimmed + ".ko", nil
-		}
+	i := strings.LastIndex(path.Base(module), ".ko")
+	if i < 0 {
+		return "", errors.New("module extension/suffix unknown")
 	}
-	return "", errors.New("module extension/suffix unknown")
+	return path.Join(path.Dir(module), path.Base(module)[:i]) + ".ko", nil
 }
 
-func (m *Machine) generateModulesDep(w *writerhelper.WriterHelper, moddir string, modules map[string]bool) error {
+// generateModulesDep writes modules.dep for the resolved modules, in the
+// order they were resolved
+func (m *Machine) generateModulesDep(w *writerhelper.WriterHelper, moddir string, db *moduleDB, modules []*kernelModule) error {
 	output := make([]string, len(modules))
-	release, err := m.backend.KernelRelease()
-	if err != nil {
-		return fmt.Errorf("failed to get kernel release: %w", err)
-	}
-	i := 0
-	for mod := range modules {
-		modpath, err := getModPath(mod, release)
-		if err != nil {
-			return fmt.Errorf("failed to get path for module %q: %w", mod, err)
-		}
-		modpath, err = stripCompressionSuffix(modpath)
+	for i, mod := range modules {
+		modpath, err := stripCompressionSuffix(m.moduleMachinePath(mod.path))
 		if err != nil {
-			return fmt.Errorf("failed to strip compression suffix for module %q: %w", mod, err)
+			return fmt.Errorf("failed to strip compression suffix for module %q: %w", mod.name, err)
 		}
-		deplist, err := getModDepends(mod, release)
-		if err != nil {
-			return fmt.Errorf("failed to get dependencies for module %q: %w", mod, err)
-		}
-		deps := make([]string, len(deplist))
-		for j, dep := range deplist {
-			deppath, err := getModPath(dep, release)
-			if err != nil {
-				return fmt.Errorf("failed to get path for dependency %q of module %q: %w", dep, mod, err)
-			}
-			deppath, err = stripCompressionSuffix(deppath)
+		deps := make([]string, len(mod.depends))
+		for j, dep := range mod.depends {
+			deppath, err := stripCompressionSuffix(m.moduleMachinePath(db.modules[dep].path))
 			if err != nil {
-				return fmt.Errorf("failed to strip compression suffix for dependency %q of module %q: %w", dep, mod, err)
+				return fmt.Errorf("failed to strip compression suffix for dependency %q of module %q: %w", dep, mod.name, err)
 			}
 			deps[j] = deppath
 		}
 		output[i] = fmt.Sprintf("%s: %s", modpath, strings.Join(deps, " "))
-		i++
 	}
 
-	path := path.Join(moddir, "modules.dep")
+	path := path.Join(m.moduleMachinePath(moddir), "modules.dep")
 	if err := w.WriteFile(path, strings.Join(output, "\n"), 0644); err != nil {
 		return fmt.Errorf("failed to write modules.dep: %w", err)
 	}
@@ -701,20 +1437,37 @@ func (m *Machine) writerKernelModules(w *writerhelper.WriterHelper, moddir strin
 		"modules.symbols"}
 
 	for _, v := range modfiles {
-		if err := w.CopyFile(moddir + "/" + v); err != nil {
+		if err := w.CopyFileTo(moddir+"/"+v, m.moduleMachinePath(moddir+"/"+v)); err != nil {
 			return fmt.Errorf("failed to copy kernel module file %s: %w", moddir+"/"+v, err)
 		}
 	}
 
-	copiedModules := make(map[string]bool)
+	db, err := m.kernelModuleDB(moddir)
+	if err != nil {
+		return fmt.Errorf("failed to load kernel modules: %w", err)
+	}
+
+	resolved, err := db.resolve(modules)
+	if err != nil {
+		return err
+	}
 
-	for _, modname := range modules {
-		if err := m.copyModules(w, modname, copiedModules); err != nil {
+	jobs := make([]writerhelper.TransformJob, 0, len(resolved))
+	for _, mod := range resolved {
+		job, err := m.moduleTransformJob(mod)
+		if err != nil {
 			return err
 		}
+		jobs = append(jobs, job)
 	}
 
-	return m.generateModulesDep(w, moddir, copiedModules)
+	// Decompressing modules is CPU bound, so spread it over the CPUs of the
+	// host; the modules are still written in a fixed order
+	if err := w.TransformFilesTo(jobs, runtime.NumCPU()); err != nil {
+		return fmt.Errorf("failed to copy kernel modules: %w", err)
+	}
+
+	return m.generateModulesDep(w, moddir, db, resolved)
 }
 
 func (m *Machine) setupscratch() error {
@@ -765,31 +1518,55 @@ func (m *Machine) cleanup() error {
 	return nil
 }
 
-func (m *Machine) buildInitrd(command string, extracontent [][2]string) (err error) {
-	f, err := os.OpenFile(m.initrdpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+// staticInitrdFiles returns the files of the host the static part of the
+// initramfs is generated from, which need to be kept in sync with
+// writeStaticInitrd
+func (m *Machine) staticInitrdFiles(kernelModuleDir string) ([]string, error) {
+	busybox, err := m.lookPath("busybox")
 	if err != nil {
-		return fmt.Errorf("failed to create initrd file: %w", err)
+		return nil, err
 	}
 
-	defer func() {
-		if closeErr := f.Close(); closeErr != nil {
-			err = errors.Join(err, fmt.Errorf("failed to close initrd file: %w", closeErr))
-		}
-	}()
+	prefix := ""
+	if m.mergedUsr {
+		prefix = "/usr"
+	}
+	dynamicLinker := archDynamicLinker[m.arch]
+	libraryDir, err := m.machineRealDir(dynamicLinker)
+	if err != nil {
+		return nil, err
+	}
 
-	kernelModuleDir, err := m.backend.ModulePath()
+	files := []string{
+		m.rootPath(busybox),
+		m.rootPath(prefix + dynamicLinker),
+		m.rootPath(libraryDir + "/libc.so.6"),
+		m.rootPath(libraryDir + "/libresolv.so.2"),
+		m.rootPath("/etc/ld.so.conf"),
+		m.rootPath("/etc/passwd"),
+		m.rootPath("/etc/group"),
+		m.rootPath("/etc/nsswitch.conf"),
+	}
+
+	confs, err := filepath.Glob(m.rootPath("/etc/ld.so.conf.d/*"))
 	if err != nil {
-		return fmt.Errorf("failed to get kernel module directory: %w", err)
+		return nil, fmt.Errorf("failed to list ld.so.conf.d: %w", err)
 	}
+	files = append(files, confs...)
 
-	w := writerhelper.NewWriterHelper(f)
-	defer func() {
-		if closeErr := w.Close(); closeErr != nil {
-			err = errors.Join(err, fmt.Errorf("failed to close cpio writer: %w", closeErr))
-		}
-	}()
+	// The modules are identified by the kernel release, the files generated
+	// by depmod change whenever modules of the same release get updated
+	for _, f := range []string{"modules.dep", "modules.builtin", "modules.alias", "modules.symbols"} {
+		files = append(files, path.Join(kernelModuleDir, f))
+	}
+
+	return files, nil
+}
 
-	err = w.WriteDirectories([]writerhelper.WriteDirectory{
+// writeStaticInitrd writes the part of the initramfs which is the same for
+// every run of the machine, see initrdCacheKey
+func (m *Machine) writeStaticInitrd(w *writerhelper.WriterHelper, kernelModuleDir string) error {
+	err := w.WriteDirectories([]writerhelper.WriteDirectory{
 		{Directory: "/scratch", Perm: 01777},
 		{Directory: "/var/tmp", Perm: 01777},
 		{Directory: "/var/lib/dbus", Perm: 0755},
@@ -837,36 +1614,36 @@ func (m *Machine) buildInitrd(command string, extracontent [][2]string) (err err
 	}
 
 	// search for busybox; in some distros it's located under /sbin
-	busybox, err := exec.LookPath("busybox")
+	busybox, err := m.lookPath("busybox")
 	if err != nil {
-		return fmt.Errorf("failed to find busybox: %w", err)
+		return err
 	}
-	err = w.CopyFileTo(busybox, prefix+"/bin/busybox")
+	err = w.CopyFileTo(m.rootPath(busybox), prefix+"/bin/busybox")
 	if err != nil {
 		return fmt.Errorf("failed to copy busybox: %w", err)
 	}
 
 	/* Ensure systemd-resolved is available */
-	if _, err := os.Stat("/lib/systemd/systemd-resolved"); err != nil {
+	if _, err := os.Stat(m.rootPath("/lib/systemd/systemd-resolved")); err != nil {
 		return fmt.Errorf("systemd-resolved not found: %w", err)
 	}
 
 	dynamicLinker := archDynamicLinker[m.arch]
-	err = w.CopyFile(prefix + dynamicLinker)
+	err = w.CopyFileTo(m.rootPath(prefix+dynamicLinker), prefix+dynamicLinker)
 	if err != nil {
 		return fmt.Errorf("failed to copy dynamic linker: %w", err)
 	}
 
 	/* C libraries */
-	libraryDir, err := realDir(dynamicLinker)
+	libraryDir, err := m.machineRealDir(dynamicLinker)
 	if err != nil {
 		return err
 	}
-	err = w.CopyFile(libraryDir + "/libc.so.6")
+	err = w.CopyFileTo(m.rootPath(libraryDir+"/libc.so.6"), libraryDir+"/libc.so.6")
 	if err != nil {
 		return fmt.Errorf("failed to copy libc.so.6: %w", err)
 	}
-	err = w.CopyFile(libraryDir + "/libresolv.so.2")
+	err = w.CopyFileTo(m.rootPath(libraryDir+"/libresolv.so.2"), libraryDir+"/libresolv.so.2")
 	if err != nil {
 		return fmt.Errorf("failed to copy libresolv.so.2: %w", err)
 	}
@@ -877,12 +1654,12 @@ func (m *Machine) buildInitrd(command string, extracontent [][2]string) (err err
 	}
 
 	// Linker configuration
-	err = w.CopyFile("/etc/ld.so.conf")
+	err = w.CopyFileTo(m.rootPath("/etc/ld.so.conf"), "/etc/ld.so.conf")
 	if err != nil {
 		return fmt.Errorf("failed to copy ld.so.conf: %w", err)
 	}
 
-	err = w.CopyTree("/etc/ld.so.conf.d")
+	err = w.CopyTreeTo(m.rootPath("/etc/ld.so.conf.d"), "/etc/ld.so.conf.d")
 	if err != nil {
 		return fmt.Errorf("failed to copy ld.so.conf.d: %w", err)
 	}
@@ -898,17 +1675,17 @@ func (m *Machine) buildInitrd(command string, extracontent [][2]string) (err err
 		return fmt.Errorf("failed to write hostname: %w", err)
 	}
 
-	err = w.CopyFile("/etc/passwd")
+	err = w.CopyFileTo(m.rootPath("/etc/passwd"), "/etc/passwd")
 	if err != nil {
 		return fmt.Errorf("failed to copy passwd: %w", err)
 	}
 
-	err = w.CopyFile("/etc/group")
+	err = w.CopyFileTo(m.rootPath("/etc/group"), "/etc/group")
 	if err != nil {
 		return fmt.Errorf("failed to copy group: %w", err)
 	}
 
-	err = w.CopyFile("/etc/nsswitch.conf")
+	err = w.CopyFileTo(m.rootPath("/etc/nsswitch.conf"), "/etc/nsswitch.conf")
 	if err != nil {
 		return fmt.Errorf("failed to copy nsswitch.conf: %w", err)
 	}
@@ -920,47 +1697,113 @@ func (m *Machine) buildInitrd(command string, extracontent [][2]string) (err err
 		return fmt.Errorf("failed to write udev rules: %w", err)
 	}
 
-	err = w.WriteFile("/etc/systemd/network/ethernet.network",
-		networkdTemplate, 0444)
+	err = w.WriteSymlink(
+		"/lib/systemd/resolv.conf",
+		"/etc/resolv.conf",
+		0755)
 	if err != nil {
-		return fmt.Errorf("failed to write ethernet.network: %w", err)
+		return fmt.Errorf("failed to write resolv.conf symlink: %w", err)
 	}
 
-	err = w.WriteFile("/etc/systemd/network/10-ethernet.link",
-		networkdLinkTemplate, 0444)
+	err = m.writerKernelModules(w, kernelModuleDir, m.initrdModules())
 	if err != nil {
-		return fmt.Errorf("failed to write ethernet.link: %w", err)
+		return fmt.Errorf("failed to write kernel modules: %w", err)
 	}
 
 	err = w.WriteSymlink(
-		"/lib/systemd/resolv.conf",
-		"/etc/resolv.conf",
+		"/lib/systemd/system/serial-getty@ttyS0.service",
+		"/dev/null",
 		0755)
 	if err != nil {
-		return fmt.Errorf("failed to write resolv.conf symlink: %w", err)
+		return fmt.Errorf("failed to write serial-getty symlink: %w", err)
 	}
 
-	err = m.writerKernelModules(w, kernelModuleDir, m.backend.InitModules())
+	return nil
+}
+
+// buildInitrd writes the initramfs of the machine to initrdpath. It consists
+// of the static part, which is cached across runs, and a concatenated archive
+// with the parts specific to this run.
+func (m *Machine) buildInitrd(command string, extracontent [][2]string, compression Compression) (err error) {
+	f, err := os.OpenFile(m.initrdpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
-		return fmt.Errorf("failed to write kernel modules: %w", err)
+		return fmt.Errorf("failed to create initrd file: %w", err)
+	}
+
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close initrd file: %w", closeErr))
+		}
+	}()
+
+	index, err := m.writeCachedInitrd(f, compression)
+	if err != nil {
+		return err
+	}
+
+	// The kernel unpacks each of the concatenated archives separately, so
+	// they are compressed separately as well
+	cw, err := newCompressor(compression, f)
+	if err != nil {
+		return err
+	}
+	w := writerhelper.NewAppendingWriterHelper(cw, index)
+	defer func() {
+		if closeErr := w.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close cpio writer: %w", closeErr))
+		}
+		if closeErr := cw.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close compressor: %w", closeErr))
+		}
+	}()
+
+	networkUnits := ""
+	wait := ""
+	if m.network != NetworkNone {
+		err = w.WriteFile("/etc/systemd/network/ethernet.network",
+			networkdTemplate, 0444)
+		if err != nil {
+			return fmt.Errorf("failed to write ethernet.network: %w", err)
+		}
+
+		err = w.WriteFile("/etc/systemd/network/10-ethernet.link",
+			networkdLinkTemplate, 0444)
+		if err != nil {
+			return fmt.Errorf("failed to write ethernet.link: %w", err)
+		}
+
+		networkUnits = "systemd-networkd.service"
+		wait = networkWait
 	}
 
 	err = w.WriteFile("etc/systemd/system/fakemachine.service",
-		fmt.Sprintf(serviceTemplate, m.backend.JobOutputTTY(), strings.Join(m.Environ, " ")), 0644)
+		fmt.Sprintf(serviceTemplate, m.backend.JobOutputTTY(), strings.Join(m.Environ, " "), networkUnits), 0644)
 	if err != nil {
 		return fmt.Errorf("failed to write fakemachine.service: %w", err)
 	}
 
-	err = w.WriteSymlink(
-		"/lib/systemd/system/serial-getty@ttyS0.service",
-		"/dev/null",
-		0755)
-	if err != nil {
-		return fmt.Errorf("failed to write serial-getty symlink: %w", err)
+	redirect := ""
+	if m.redirectStreams() {
+		stdin, stdout, stderr := m.backend.JobStreamDevices()
+		if m.stdin == nil {
+			stdin = "/dev/null"
+		}
+		redirect = fmt.Sprintf(streamsRedirect, stdin, stdout, stderr)
+	}
+
+	fileMounts := ""
+	for i, f := range m.fileMounts {
+		src := path.Join(fileMountDirectory, strconv.Itoa(i))
+		err = w.CopyFileTo(f.hostFile, src)
+		if err != nil {
+			return fmt.Errorf("failed to copy file volume %s: %w", f.hostFile, err)
+		}
+
+		fileMounts += fmt.Sprintf(fileMountCommand, src, shellescape.Quote(f.machineFile))
 	}
 
 	err = w.WriteFile("/wrapper",
-		fmt.Sprintf(commandWrapper, command), 0755)
+		fmt.Sprintf(commandWrapper, command, redirect, wait, fileMounts), 0755)
 	if err != nil {
 		return fmt.Errorf("failed to write wrapper script: %w", err)
 	}
@@ -987,47 +1830,154 @@ func (m *Machine) buildInitrd(command string, extracontent [][2]string) (err err
 		}
 	}
 
+	if err := m.writeInitrdFiles(w); err != nil {
+		return err
+	}
+	return m.writeFileMountTargets(w)
+}
+
+// onVolume returns whether the machine path p is on one of the volumes
+func (m *Machine) onVolume(p string) bool {
+	p = path.Clean(p)
+	for _, mount := range m.mounts {
+		dir := path.Clean(mount.machineDirectory)
+		if p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeFileMountTargets adds empty files to the initramfs for the file
+// volumes to be mounted over, unless the initramfs already has them. Targets
+// on volumes have to exist instead, as creating them would change the host.
+func (m *Machine) writeFileMountTargets(w *writerhelper.WriterHelper) error {
+	for _, f := range m.fileMounts {
+		if w.Contains(f.machineFile) || m.onVolume(f.machineFile) {
+			continue
+		}
+		if err := w.WriteFile(f.machineFile, "", 0644); err != nil {
+			return fmt.Errorf("failed to add file volume target %s to initramfs: %w", f.machineFile, err)
+		}
+	}
 	return nil
 }
 
+// TerminatedError is returned when the machine was terminated before the
+// command finished because the context passed to one of the Run*Context
+// functions was cancelled or its deadline passed.
+type TerminatedError struct {
+	// Backend is the name of the backend which was terminated
+	Backend string
+	// Err is the reason of the termination; either context.Canceled or
+	// context.DeadlineExceeded
+	Err error
+}
+
+func (e *TerminatedError) Error() string {
+	if e.Timeout() {
+		return fmt.Sprintf("%s backend timed out: %v", e.Backend, e.Err)
+	}
+	return fmt.Sprintf("%s backend terminated: %v", e.Backend, e.Err)
+}
+
+func (e *TerminatedError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the machine was terminated because the context
+// deadline passed
+func (e *TerminatedError) Timeout() bool {
+	return errors.Is(e.Err, context.DeadlineExceeded)
+}
+
 // Start the machine running the given command and adding the extra content to
 // the cpio. Extracontent is a list of {source, dest} tuples
-func (m *Machine) startup(command string, extracontent [][2]string) (code int, err error) {
+func (m *Machine) startup(ctx context.Context, command string, extracontent [][2]string) (result RunResult, err error) {
+	result = RunResult{Backend: m.backend.Name(), ExitCode: -1, FailedPhase: PhaseSetup}
+
 	defer func() {
 		if cleanupErr := m.cleanup(); cleanupErr != nil {
 			err = errors.Join(err, fmt.Errorf("cleanup failed: %w", cleanupErr))
 		}
 	}()
 
+	if err := ctx.Err(); err != nil {
+		return result, &TerminatedError{Backend: m.backend.Name(), Err: err}
+	}
+
 	if err := os.Setenv("PATH", os.Getenv("PATH")+":/sbin:/usr/sbin"); err != nil {
-		return -1, fmt.Errorf("failed to set PATH: %w", err)
+		return result, fmt.Errorf("failed to set PATH: %w", err)
 	}
 
 	/* Sanity check mountpoints */
+	if err := errors.Join(m.mountErrors...); err != nil {
+		return result, err
+	}
 	for _, v := range m.mounts {
 		/* Check the directory exists on the host */
 		stat, err := os.Stat(v.hostDirectory)
 		if err != nil {
-			return -1, fmt.Errorf("couldn't stat %s: %w", v.hostDirectory, err)
+			return result, fmt.Errorf("couldn't stat %s: %w", v.hostDirectory, err)
 		}
 		if !stat.IsDir() {
-			return -1, fmt.Errorf("couldn't mount %s inside machine: expected a directory", v.hostDirectory)
+			return result, fmt.Errorf("couldn't mount %s inside machine: expected a directory", v.hostDirectory)
 		}
 
 		/* Check for whitespace in the machine directory */
-		if regexp.MustCompile(`\s`).MatchString(v.machineDirectory) {
-			return -1, fmt.Errorf("couldn't mount %s inside machine: machine directory (%s) contains whitespace", v.hostDirectory, v.machineDirectory)
+		if strings.ContainsFunc(v.machineDirectory, unicode.IsSpace) {
+			return result, fmt.Errorf("couldn't mount %s inside machine: machine directory (%s) contains whitespace", v.hostDirectory, v.machineDirectory)
 		}
 
 		/* Check for whitespace in the label */
-		if regexp.MustCompile(`\s`).MatchString(v.label) {
-			return -1, fmt.Errorf("couldn't mount %s inside machine: label (%s) contains whitespace", v.hostDirectory, v.label)
+		if strings.ContainsFunc(v.label, unicode.IsSpace) {
+			return result, fmt.Errorf("couldn't mount %s inside machine: label (%s) contains whitespace", v.hostDirectory, v.label)
+		}
+
+		if err := v.options.validate(); err != nil {
+			return result, fmt.Errorf("couldn't mount %s inside machine: %w", v.hostDirectory, err)
+		}
+	}
+
+	for _, f := range m.fileMounts {
+		stat, err := os.Stat(f.hostFile)
+		if err != nil {
+			return result, fmt.Errorf("couldn't stat %s: %w", f.hostFile, err)
+		}
+		// Sockets and devices can't be passed through to the machine
+		if !stat.Mode().IsRegular() {
+			return result, fmt.Errorf("couldn't mount %s inside machine: expected a regular file", f.hostFile)
+		}
+
+		if !path.IsAbs(f.machineFile) || strings.ContainsFunc(f.machineFile, unicode.IsSpace) {
+			return result, fmt.Errorf("couldn't mount %s inside machine: invalid machine path (%s)", f.hostFile, f.machineFile)
+		}
+	}
+
+	if m.network == NetworkNone && len(m.forwards) > 0 {
+		return result, errors.New("port forwarding requires a network connection")
+	}
+
+	m.virtiofsd = ""
+	m.moduleDB = nil
+	if m.sharing == SharingVirtiofs {
+		if err := m.setupVirtiofs(); err != nil {
+			if !m.quiet {
+				fmt.Printf("Falling back to 9p for volumes: %v\n", err)
+			}
 		}
 	}
 
+	if err := m.checkKernel(); err != nil {
+		return result, err
+	}
+	if err := m.addModuleVolume(); err != nil {
+		return result, err
+	}
+
 	tmpdir, err := os.MkdirTemp("", "fakemachine-")
 	if err != nil {
-		return -1, fmt.Errorf("failed to create temp directory: %w", err)
+		return result, fmt.Errorf("failed to create temp directory: %w", err)
 	}
 	m.AddVolumeAt(tmpdir, "/run/fakemachine")
 	defer func() {
@@ -1038,64 +1988,125 @@ func (m *Machine) startup(command string, extracontent [][2]string) (code int, e
 
 	err = m.setupscratch()
 	if err != nil {
-		return -1, err
+		return result, err
+	}
+
+	compression, err := m.initrdCompression()
+	if err != nil {
+		return result, err
 	}
 
 	m.initrdpath = path.Join(tmpdir, "initramfs.cpio")
-	if err := m.buildInitrd(command, extracontent); err != nil {
-		return -1, err
+	if err := m.buildInitrd(command, extracontent, compression); err != nil {
+		return result, err
 	}
 
-	if !m.quiet {
+	if !m.quiet && compression != CompressionNone {
+		if info, err := os.Stat(m.initrdpath); err == nil {
+			fmt.Printf("Initramfs compressed with %s to %.1f MiB\n", compression, float64(info.Size())/(1024*1024))
+		}
+	}
+
+	// Sessions announce themselves rather than their agent script
+	if !m.quiet && m.agentSocket == "" {
 		fmt.Printf("Running %s using %s backend\n", command, m.backend.Name())
 	}
 
-	// Set a default result of failure so that if the backend fails to start
-	// we get a defined exit code instead of an error reading the result file.
+	// Create an empty result file for the wrapper script to record the
+	// progress of the command in, see parseRunResult
 	resultPath := path.Join(tmpdir, "result")
-	if err := os.WriteFile(resultPath, []byte("1"), 0644); err != nil {
-		return -1, fmt.Errorf("failed to create result file: %w", err)
+	if err := os.WriteFile(resultPath, nil, 0644); err != nil {
+		return result, fmt.Errorf("failed to create result file: %w", err)
 	}
 
-	success, err := m.backend.Start()
+	result.FailedPhase = PhaseBackend
+	success, err := m.backend.Start(ctx)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		// Record how far the machine got before being terminated
+		if data, readErr := os.ReadFile(resultPath); readErr == nil {
+			_ = parseRunResult(data, &result)
+		}
+		return result, &TerminatedError{Backend: m.backend.Name(), Err: ctxErr}
+	}
 	if err != nil {
-		return -1, fmt.Errorf("error starting %s backend: %w", m.backend.Name(), err)
+		return result, fmt.Errorf("error starting %s backend: %w", m.backend.Name(), err)
 	}
 	if !success {
-		return -1, fmt.Errorf("error starting %s backend: unknown error", m.backend.Name())
+		return result, fmt.Errorf("error starting %s backend: backend exited with failure", m.backend.Name())
 	}
 
-	result, err := os.Open(resultPath)
+	data, err := os.ReadFile(resultPath)
 	if err != nil {
-		return -1, fmt.Errorf("failed to open result file: %w", err)
+		return result, fmt.Errorf("failed to read result file: %w", err)
 	}
-	defer func() {
-		if closeErr := result.Close(); closeErr != nil {
-			err = errors.Join(err, fmt.Errorf("failed to close result file: %w", closeErr))
-		}
-	}()
 
-	exitstr, err := io.ReadAll(result)
-	if err != nil {
-		return -1, fmt.Errorf("failed to read result file: %w", err)
+	result.FailedPhase = PhaseNone
+	if err := parseRunResult(data, &result); err != nil {
+		return result, err
 	}
-	exitcode, err := strconv.Atoi(strings.TrimSpace(string(exitstr)))
 
+	panicked, err := m.backend.KernelPanicked()
 	if err != nil {
-		return -1, fmt.Errorf("failed to parse exit code: %w", err)
+		return result, fmt.Errorf("failed to check for kernel panic: %w", err)
+	}
+	if panicked {
+		result.ExitCode = -1
+		result.FailedPhase = PhaseKernelPanic
 	}
 
-	return exitcode, nil
+	return result, nil
+}
+
+// exitCode returns the exit code reported by Run for result. Failures inside
+// the machine before the command finished have always been reported as exit
+// code 1.
+func (result RunResult) exitCode(err error) int {
+	switch {
+	case err != nil:
+		return -1
+	case result.FailedPhase != PhaseNone:
+		return 1
+	default:
+		return result.ExitCode
+	}
 }
 
 // Run creates the machine running the given command
 func (m *Machine) Run(command string) (int, error) {
-	return m.startup(command, nil)
+	return m.RunContext(context.Background(), command)
+}
+
+// RunContext creates the machine running the given command. If ctx is
+// cancelled or its deadline passes before the command finishes the machine is
+// terminated and a *TerminatedError is returned.
+func (m *Machine) RunContext(ctx context.Context, command string) (int, error) {
+	result, err := m.startup(ctx, command, nil)
+	return result.exitCode(err), err
+}
+
+// RunWithResult creates the machine running the given command and describes
+// the outcome in detail. An error is only returned for failures on the host,
+// i.e. when FailedPhase is PhaseSetup or PhaseBackend, or when the machine was
+// terminated; failures inside the machine are only reported by the result.
+func (m *Machine) RunWithResult(command string) (RunResult, error) {
+	return m.RunWithResultContext(context.Background(), command)
+}
+
+// RunWithResultContext is like RunWithResult but terminates the machine when
+// ctx is cancelled, see RunContext.
+func (m *Machine) RunWithResultContext(ctx context.Context, command string) (RunResult, error) {
+	return m.startup(ctx, command, nil)
 }
 
 // RunInMachineWithArgs runs the caller binary inside the fakemachine with the
 // specified commandline arguments
 func (m *Machine) RunInMachineWithArgs(args []string) (int, error) {
+	return m.RunInMachineWithArgsContext(context.Background(), args)
+}
+
+// RunInMachineWithArgsContext is like RunInMachineWithArgs but terminates the
+// machine when ctx is cancelled, see RunContext.
+func (m *Machine) RunInMachineWithArgsContext(ctx context.Context, args []string) (int, error) {
 	name := path.Join("/", path.Base(os.Args[0]))
 
 	quotedArgs := shellescape.QuoteCommand(args)
@@ -1107,7 +2118,8 @@ func (m *Machine) RunInMachineWithArgs(args []string) (int, error) {
 		return -1, fmt.Errorf("failed to find executable: %w", err)
 	}
 
-	return m.startup(command, [][2]string{{executable, name}})
+	result, err := m.startup(ctx, command, [][2]string{{executable, name}})
+	return result.exitCode(err), err
 }
 
 // RunInMachine runs the caller binary inside the fakemachine with the same
@@ -1115,3 +2127,9 @@ func (m *Machine) RunInMachineWithArgs(args []string) (int, error) {
 func (m *Machine) RunInMachine() (int, error) {
 	return m.RunInMachineWithArgs(os.Args[1:])
 }
+
+// RunInMachineContext is like RunInMachine but terminates the machine when ctx
+// is cancelled, see RunContext.
+func (m *Machine) RunInMachineContext(ctx context.Context) (int, error) {
+	return m.RunInMachineWithArgsContext(ctx, os.Args[1:])
+}
@@ -2,15 +2,26 @@ package fakemachine
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
+	"net"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	writerhelper "github.com/go-debos/fakemachine/cpio"
 	"github.com/stretchr/testify/require"
+	"github.com/surma/gocpio"
 )
 
 var backendName string
@@ -45,6 +56,123 @@ func TestCommandNotFound(t *testing.T) {
 	require.Equal(t, 127, exitcode)
 }
 
+func TestTimeout(t *testing.T) {
+	m := CreateMachine(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	exitcode, err := m.RunContext(ctx, "sleep 3600")
+	require.Equal(t, -1, exitcode)
+
+	var terminatedErr *TerminatedError
+	require.True(t, errors.As(err, &terminatedErr), "expected a TerminatedError, got %v", err)
+	require.True(t, terminatedErr.Timeout())
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestCancelledBeforeStart(t *testing.T) {
+	m := CreateMachine(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	exitcode, err := m.RunContext(ctx, "true")
+	require.Equal(t, -1, exitcode)
+	require.ErrorIs(t, err, context.Canceled)
+
+	var terminatedErr *TerminatedError
+	require.True(t, errors.As(err, &terminatedErr))
+	require.False(t, terminatedErr.Timeout())
+}
+
+func TestRedirectStreams(t *testing.T) {
+	m := CreateMachine(t)
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	m.SetStdin(strings.NewReader("input\n"))
+	m.SetStdout(stdout)
+	m.SetStderr(stderr)
+
+	exitcode, err := m.Run("read line; echo \"out: $line\"; echo err >&2")
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+	require.Equal(t, "out: input\n", stdout.String())
+	require.Equal(t, "err\n", stderr.String())
+}
+
+func TestNetworkNone(t *testing.T) {
+	require.Error(t, (&Machine{}).SetNetwork("bridge"))
+
+	m := CreateMachine(t)
+	require.NoError(t, m.SetNetwork(NetworkNone))
+
+	/* Only the loopback interface exists */
+	exitcode, err := m.Run(`test "$(ls /sys/class/net)" = lo`)
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+}
+
+func TestPortForward(t *testing.T) {
+	const guestPort = 8080
+
+	if InMachine() {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", guestPort))
+		require.NoError(t, err)
+		defer listener.Close()
+
+		conn, err := listener.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		return
+	}
+
+	m := CreateMachine(t)
+
+	_, err := m.AddPortForward("sctp", "", 0, guestPort)
+	require.Error(t, err)
+	_, err = m.AddPortForward("tcp", "", 0, 0)
+	require.Error(t, err)
+
+	hostPort, err := m.AddPortForward("tcp", "127.0.0.1", 0, guestPort)
+	require.NoError(t, err)
+	require.NotZero(t, hostPort)
+
+	// Until the guest listens user mode networking accepts and immediately
+	// closes connections, so keep trying until the greeting arrives
+	received := make(chan string, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for ctx.Err() == nil {
+			conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", hostPort))
+			if err == nil {
+				data, _ := io.ReadAll(conn)
+				conn.Close()
+				if len(data) > 0 {
+					received <- string(data)
+					return
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}()
+
+	exitcode, err := m.RunInMachineWithArgs([]string{"-test.run", "TestPortForward"})
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+	select {
+	case data := <-received:
+		require.Equal(t, "hello", data)
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "no data received through forwarded port")
+	}
+}
+
 func TestImage(t *testing.T) {
 	m := CreateMachine(t)
 
@@ -248,6 +376,478 @@ func TestVolumes(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestForeignArchNeedsSysroot(t *testing.T) {
+	arch := Arm64
+	if archMap[runtime.GOARCH] == Arm64 {
+		arch = Amd64
+	}
+
+	_, err := NewMachineWithOptions(MachineOptions{Backend: backendName, Arch: arch})
+	require.Error(t, err)
+}
+
+func TestResolveIn(t *testing.T) {
+	root := t.TempDir()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "usr/lib/triplet"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "usr/lib/triplet/ld.so"), nil, 0755))
+	require.NoError(t, os.Symlink("usr/lib", filepath.Join(root, "lib")))
+	require.NoError(t, os.Symlink("/lib/triplet/ld.so", filepath.Join(root, "usr/lib/ld.so")))
+	require.NoError(t, os.Symlink("../lib/ld.so", filepath.Join(root, "usr/ld.so")))
+
+	cases := map[string]string{
+		"/lib/triplet/ld.so": "/usr/lib/triplet/ld.so",
+		"/lib/ld.so":         "/usr/lib/triplet/ld.so",
+		"/usr/ld.so":         "/usr/lib/triplet/ld.so",
+		"/usr/../lib":        "/usr/lib",
+	}
+	for p, want := range cases {
+		got, err := resolveIn(root, p)
+		require.NoError(t, err, "resolveIn(%s)", p)
+		require.Equal(t, want, got, "resolveIn(%s)", p)
+	}
+
+	_, err := resolveIn(root, "/does/not/exist")
+	require.Error(t, err)
+}
+
+func TestKernelImageRelease(t *testing.T) {
+	dir := t.TempDir()
+
+	// Minimal x86 boot protocol setup header pointing at a version string
+	bzImage := make([]byte, 0x400)
+	copy(bzImage[0x202:], "HdrS")
+	bzImage[0x20e] = 0x00
+	bzImage[0x20f] = 0x01
+	copy(bzImage[0x300:], "6.1.0-9-amd64 (debian-kernel@lists.debian.org) #1 SMP\x00")
+	bzImagePath := filepath.Join(dir, "bzImage")
+	require.NoError(t, os.WriteFile(bzImagePath, bzImage, 0644))
+
+	release, err := kernelImageRelease(bzImagePath)
+	require.NoError(t, err)
+	require.Equal(t, "6.1.0-9-amd64", release)
+
+	otherPath := filepath.Join(dir, "Image")
+	require.NoError(t, os.WriteFile(otherPath, make([]byte, 0x400), 0644))
+
+	release, err = kernelImageRelease(otherPath)
+	require.NoError(t, err)
+	require.Empty(t, release)
+}
+
+func TestKernelPath(t *testing.T) {
+	sysroot := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(sysroot, "lib/modules/6.1.0-9-powerpc64le"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(sysroot, "boot"), 0755))
+
+	m := &Machine{arch: Ppc64el, sysroot: sysroot}
+	m.backend = newQemuBackend(m)
+
+	_, err := m.backend.KernelPath()
+	require.ErrorContains(t, err, "vmlinux-6.1.0-9-powerpc64le")
+
+	vmlinux := filepath.Join(sysroot, "boot/vmlinux-6.1.0-9-powerpc64le")
+	require.NoError(t, os.WriteFile(vmlinux, nil, 0644))
+	kernelPath, err := m.backend.KernelPath()
+	require.NoError(t, err)
+	require.Equal(t, vmlinux, kernelPath)
+
+	vmlinuz := filepath.Join(sysroot, "boot/vmlinuz-6.1.0-9-powerpc64le")
+	require.NoError(t, os.WriteFile(vmlinuz, nil, 0644))
+	kernelPath, err = m.backend.KernelPath()
+	require.NoError(t, err)
+	require.Equal(t, vmlinuz, kernelPath)
+}
+
+func TestModuleBaseDir(t *testing.T) {
+	m := &Machine{}
+	require.Empty(t, m.moduleBaseDir())
+
+	m.SetKernel("", "/srv/kernel/usr/lib/modules/6.1.0-9-amd64/")
+	require.Equal(t, "/srv/kernel/usr", m.moduleBaseDir())
+	require.Equal(t, "/lib/modules/6.1.0-9-amd64/kernel/fs/9p/9p.ko",
+		m.moduleMachinePath("/srv/kernel/usr/lib/modules/6.1.0-9-amd64/kernel/fs/9p/9p.ko"))
+}
+
+func TestStripCompressionSuffix(t *testing.T) {
+	for module, expected := range map[string]string{
+		"/lib/modules/6.1.0-9-amd64/kernel/fs/9p/9p.ko":        "/lib/modules/6.1.0-9-amd64/kernel/fs/9p/9p.ko",
+		"/lib/modules/6.1.0-9-amd64/kernel/fs/9p/9p.ko.xz":     "/lib/modules/6.1.0-9-amd64/kernel/fs/9p/9p.ko",
+		"/lib/modules/6.1.0-9-amd64/kernel/fs/9p/9p.ko.bz2":    "/lib/modules/6.1.0-9-amd64/kernel/fs/9p/9p.ko",
+		"/lib/modules/6.1.0-9-amd64/kernel/fs/9p/9p.ko.lz4":    "/lib/modules/6.1.0-9-amd64/kernel/fs/9p/9p.ko",
+		"/lib/modules/6.1.0-9-amd64.ko/kernel/fs/9p/9p.ko.zst": "/lib/modules/6.1.0-9-amd64.ko/kernel/fs/9p/9p.ko",
+	} {
+		stripped, err := stripCompressionSuffix(module)
+		require.NoError(t, err)
+		require.Equal(t, expected, stripped)
+	}
+
+	_, err := stripCompressionSuffix("/lib/modules/6.1.0-9-amd64/modules.dep")
+	require.Error(t, err)
+}
+
+func TestReadOnlyVolume(t *testing.T) {
+	dir := t.TempDir()
+	m := CreateMachine(t)
+	m.AddVolumeWithOptions(dir, "/run/read-only", VolumeOptions{ReadOnly: true})
+
+	exitcode, err := m.Run("! touch /run/read-only/file")
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+	require.NoFileExists(t, path.Join(dir, "file"))
+}
+
+func TestFileMountTargets(t *testing.T) {
+	m := &Machine{}
+	m.AddVolumeAt("/srv", "/srv/volume")
+	m.AddFileVolumeAt("/host/a", "/etc/fakemachine-test/a")
+	m.AddFileVolumeAt("/host/b", "/srv/volume/b")
+	m.AddFileVolumeAt("/host/c", "/srv/volumes/c")
+
+	out := &bytes.Buffer{}
+	w := writerhelper.NewWriterHelper(out)
+	require.NoError(t, w.WriteFile("/srv/volumes/c", "existing", 0644))
+	require.NoError(t, m.writeFileMountTargets(w))
+
+	require.NoError(t, w.Close())
+
+	var names []string
+	r := writerhelper.NewReader(out)
+	for {
+		entry, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		if entry.Type != cpio.TYPE_DIR {
+			names = append(names, entry.Name)
+		}
+	}
+	require.Equal(t, []string{"/srv/volumes/c", "/etc/fakemachine-test/a"}, names)
+}
+
+func TestDuplicateVolume(t *testing.T) {
+	dir := t.TempDir()
+	m := &Machine{}
+
+	m.AddVolumeAt(dir, "/run/volume")
+	m.AddVolumeAt(dir, "/run/volume")
+	require.Len(t, m.mounts, 1)
+	require.Empty(t, m.mountErrors)
+
+	/* Options of the first call must not silently win */
+	m.AddVolumeWithOptions(dir, "/run/volume", VolumeOptions{ReadOnly: true})
+	require.Len(t, m.mounts, 1)
+	require.Len(t, m.mountErrors, 1)
+}
+
+func TestFileVolume(t *testing.T) {
+	file := path.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, []byte("single file\n"), 0600))
+
+	m := CreateMachine(t)
+	m.AddFileVolumeAt(file, "/etc/fakemachine-test/file")
+
+	exitcode, err := m.Run("grep -qx 'single file' /etc/fakemachine-test/file")
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+
+	/* Existing files on volumes can be mounted over */
+	volume := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(volume, "existing"), []byte("original\n"), 0644))
+	m = CreateMachine(t)
+	m.AddVolumeAt(volume, "/run/volume")
+	m.AddFileVolumeAt(file, "/run/volume/existing")
+
+	exitcode, err = m.Run("grep -qx 'single file' /run/volume/existing")
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+
+	/* Missing files on volumes aren't created, as that changes the host */
+	m = CreateMachine(t)
+	m.AddVolumeAt(volume, "/run/volume")
+	m.AddFileVolumeAt(file, "/run/volume/missing")
+
+	result, err := m.RunWithResult("true")
+	require.NoError(t, err)
+	require.Equal(t, PhaseFileVolume, result.FailedPhase)
+	require.Equal(t, -1, result.ExitCode)
+
+	exitcode, err = m.Run("true")
+	require.NoError(t, err)
+	require.Equal(t, 1, exitcode)
+	require.NoFileExists(t, path.Join(volume, "missing"))
+
+	/* Only regular files can be added */
+	m = CreateMachine(t)
+	m.AddFileVolumeAt(t.TempDir(), "/etc/directory")
+
+	exitcode, err = m.Run("true")
+	require.Error(t, err)
+	require.Equal(t, -1, exitcode)
+}
+
+func TestInitrdFiles(t *testing.T) {
+	file := path.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, []byte("copied\n"), 0644))
+
+	m := CreateMachine(t)
+	require.Error(t, m.AddFileContent("relative", nil, 0644))
+	require.NoError(t, m.AddFile(file, "/etc/fakemachine-test/copied"))
+	require.NoError(t, m.AddFileContent("/etc/fakemachine-test/content", []byte("content\n"), 0600))
+	require.NoError(t, m.AddSymlink("content", "/etc/fakemachine-test/link"))
+
+	tree := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(tree, "file"), []byte("tree\n"), 0644))
+	require.NoError(t, os.Link(path.Join(tree, "file"), path.Join(tree, "hardlink")))
+	require.NoError(t, os.Symlink("file", path.Join(tree, "symlink")))
+	require.NoError(t, m.AddTree(tree, "/etc/fakemachine-tree"))
+
+	exitcode, err := m.Run("grep -qx copied /etc/fakemachine-test/copied && grep -qx content /etc/fakemachine-test/link && " +
+		"grep -qx tree /etc/fakemachine-tree/symlink && test /etc/fakemachine-tree/file -ef /etc/fakemachine-tree/hardlink")
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+
+	/* Files generated by fakemachine can't be replaced */
+	m = CreateMachine(t)
+	require.NoError(t, m.AddFileContent("/etc/hostname", []byte("replaced\n"), 0644))
+
+	exitcode, err = m.Run("true")
+	require.Error(t, err)
+	require.Equal(t, -1, exitcode)
+}
+
+func TestInitrdCache(t *testing.T) {
+	cache := t.TempDir()
+	t.Setenv("XDG_CACHE_HOME", cache)
+
+	for i := 0; i < 2; i++ {
+		m := CreateMachine(t)
+		exitcode, err := m.Run(fmt.Sprintf("echo run %d", i))
+		require.NoError(t, err)
+		require.Equal(t, 0, exitcode)
+	}
+
+	/* Both runs share the same static initramfs */
+	archives, err := filepath.Glob(path.Join(cache, "fakemachine", "*.cpio"))
+	require.NoError(t, err)
+	require.Len(t, archives, 1)
+
+	/* An archive missing from the cache gets regenerated */
+	require.NoError(t, os.Remove(archives[0]))
+	m := CreateMachine(t)
+	exitcode, err := m.Run("true")
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+	require.FileExists(t, archives[0])
+}
+
+func TestKernelModules(t *testing.T) {
+	m := CreateMachine(t)
+	m.AddKernelModules("loop")
+
+	exitcode, err := m.Run("test -d /sys/module/loop")
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+
+	/* Missing modules are reported before the machine starts */
+	m = CreateMachine(t)
+	m.AddKernelModules("fakemachine_no_such_module")
+
+	exitcode, err = m.Run("true")
+	require.ErrorContains(t, err, "fakemachine_no_such_module")
+	require.Equal(t, -1, exitcode)
+}
+
+func TestSharedModuleDir(t *testing.T) {
+	m := CreateMachine(t)
+	moddir, err := m.backend.ModulePath()
+	require.NoError(t, err)
+
+	modulesDep, err := os.ReadFile(path.Join(moddir, "modules.dep"))
+	require.NoError(t, err)
+	var squashfs string
+	for _, line := range strings.Split(string(modulesDep), "\n") {
+		if mod, deps, _ := strings.Cut(line, ":"); moduleName(mod) == "squashfs" && deps == "" {
+			squashfs = mod
+		}
+	}
+	if squashfs == "" {
+		t.Skip("squashfs isn't a module without dependencies")
+	}
+
+	/* A module directory only known to the machine through SetKernel, with
+	 * squashfs under another name. The binary indexes are left out, so
+	 * modprobe uses modules.dep. */
+	custom := path.Join(t.TempDir(), "lib/modules", path.Base(moddir))
+	require.NoError(t, os.MkdirAll(path.Join(custom, "extra"), 0755))
+	entries, err := os.ReadDir(moddir)
+	require.NoError(t, err)
+	for _, e := range entries {
+		if e.Name() != "modules.dep" && !strings.HasSuffix(e.Name(), ".bin") {
+			require.NoError(t, os.Symlink(path.Join(moddir, e.Name()), path.Join(custom, e.Name())))
+		}
+	}
+	renamed := "extra/fakemachine_test" + strings.TrimPrefix(path.Base(squashfs), "squashfs")
+	require.NoError(t, os.Symlink(path.Join(moddir, squashfs), path.Join(custom, renamed)))
+	modulesDep = append(modulesDep, renamed+":\n"...)
+	require.NoError(t, os.WriteFile(path.Join(custom, "modules.dep"), modulesDep, 0644))
+
+	m.SetKernel("", custom)
+	exitcode, err := m.Run("modprobe fakemachine_test && test -d /sys/module/squashfs")
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+}
+
+func TestReproducibleInitrd(t *testing.T) {
+	var hashes [][sha256.Size]byte
+	for i := 0; i < 2; i++ {
+		/* Use an empty cache so the whole initramfs gets generated */
+		t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+		m := CreateMachine(t)
+		m.initrdpath = path.Join(t.TempDir(), "initramfs.cpio")
+		require.NoError(t, m.buildInitrd("true", nil, CompressionNone))
+
+		data, err := os.ReadFile(m.initrdpath)
+		require.NoError(t, err)
+		hashes = append(hashes, sha256.Sum256(data))
+	}
+
+	require.Equal(t, hashes[0], hashes[1])
+}
+
+func TestInitrdContents(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+
+	m := CreateMachine(t)
+	m.initrdpath = path.Join(t.TempDir(), "initramfs.cpio")
+	require.NoError(t, m.buildInitrd("true", nil, CompressionZstd))
+
+	moddir, err := m.backend.ModulePath()
+	require.NoError(t, err)
+
+	f, err := os.Open(m.initrdpath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	r := writerhelper.NewReader(f)
+	defer r.Close()
+
+	entries := map[string]bool{}
+	for {
+		entry, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		entries[path.Clean("/"+entry.Name)] = true
+	}
+
+	for _, p := range []string{
+		"/init",
+		"/wrapper",
+		"/etc/fstab",
+		"/etc/systemd/system/fakemachine.service",
+		path.Join(m.moduleMachinePath(moddir), "modules.dep"),
+	} {
+		require.True(t, entries[p], "%s missing from initramfs", p)
+	}
+}
+
+func TestVolumeOptions(t *testing.T) {
+	require.NoError(t, VolumeOptions{}.validate())
+	require.NoError(t, VolumeOptions{Cache: "none", Msize: 512 * 1024, Access: "1000"}.validate())
+	require.Error(t, VolumeOptions{Cache: "lose"}.validate())
+	require.Error(t, VolumeOptions{Msize: -1}.validate())
+	require.Error(t, VolumeOptions{Access: "nobody"}.validate())
+
+	b := newQemuBackend(&Machine{})
+
+	fstype, options := b.MountParameters(mountPoint{})
+	require.Equal(t, "9p", fstype)
+	require.Equal(t, []string{"trans=virtio", "version=9p2000.L", "cache=loose", "msize=262144"}, options)
+
+	_, options = b.MountParameters(mountPoint{options: VolumeOptions{ReadOnly: true, Cache: "none", Msize: 65536, Access: "any"}})
+	require.Equal(t, []string{"trans=virtio", "version=9p2000.L", "cache=none", "msize=65536", "access=any", "ro"}, options)
+}
+
+func TestVirtiofs(t *testing.T) {
+	const machineDir = "/run/virtiofs-test"
+
+	if InMachine() {
+		mounts, err := os.ReadFile("/proc/mounts")
+		require.NoError(t, err)
+
+		fstype := ""
+		for _, line := range strings.Split(string(mounts), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 2 && fields[1] == machineDir {
+				fstype = fields[2]
+			}
+		}
+		require.Equal(t, testArg, fstype)
+
+		err = os.WriteFile(path.Join(machineDir, "written"), []byte("virtiofs"), 0644)
+		require.NoError(t, err)
+		return
+	}
+
+	dir := t.TempDir()
+	m := CreateMachine(t)
+	m.SetVolumeSharing(SharingVirtiofs)
+
+	// virtiofs needs both virtiofsd on the host and support by the kernel
+	fstype := "9p"
+	if err := m.setupVirtiofs(); err == nil {
+		fstype = "virtiofs"
+	}
+	m.AddVolumeAt(dir, machineDir)
+
+	exitcode, err := m.RunInMachineWithArgs([]string{"-test.run", "TestVirtiofs", "-testarg", fstype})
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+
+	data, err := os.ReadFile(path.Join(dir, "written"))
+	require.NoError(t, err)
+	require.Equal(t, "virtiofs", string(data))
+}
+
+func TestKernelArgs(t *testing.T) {
+	if InMachine() {
+		cmdline, err := os.ReadFile("/proc/cmdline")
+		require.NoError(t, err)
+		require.Contains(t, strings.Fields(string(cmdline)), "fakemachine.test=yes")
+		return
+	}
+
+	m := CreateMachine(t)
+
+	require.Error(t, m.AppendKernelArgs([]string{"console=tty0"}))
+	require.Error(t, m.AppendKernelArgs([]string{"systemd.unit=rescue.target"}))
+	require.Error(t, m.AppendKernelArgs([]string{"quiet systemd.unit=rescue.target"}))
+	require.Error(t, m.AppendKernelArgs([]string{""}))
+	require.NoError(t, m.AppendKernelArgs([]string{"fakemachine.test=yes", "mitigations=off"}))
+
+	exitcode, err := m.RunInMachineWithArgs([]string{"-test.run", "TestKernelArgs"})
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+}
+
+func TestReservedKernelArgs(t *testing.T) {
+	m := &Machine{arch: Amd64}
+	m.backend = newQemuBackend(m)
+
+	for _, arg := range []string{"console=tty0", "panic=0", "init=/bin/sh",
+		"rdinit=/bin/sh", "--", "init", ""} {
+		require.Error(t, m.AppendKernelArgs([]string{"quiet", arg}), arg)
+	}
+	require.Empty(t, m.kernelArgs)
+
+	require.NoError(t, m.AppendKernelArgs([]string{"quiet", "initcall_debug", "--foo"}))
+	require.Equal(t, []string{"quiet", "initcall_debug", "--foo"}, m.kernelArgs)
+}
+
 func TestDiskSuffix(t *testing.T) {
 	cases := []struct {
 		i    int
@@ -0,0 +1,198 @@
+package fakemachine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// kernelModule is a module of a kernel release
+type kernelModule struct {
+	name string
+	// path is the location of the module file on the host, empty for
+	// modules built into the kernel
+	path string
+	// depends are the names of all modules this module depends on, directly
+	// or indirectly, in the order given by modules.dep
+	depends []string
+}
+
+func (k *kernelModule) builtin() bool {
+	return k.path == ""
+}
+
+type moduleAlias struct {
+	pattern string
+	name    string
+}
+
+// moduleDB is the module dependency graph of a kernel release, as described
+// by the files depmod generates in its module directory
+type moduleDB struct {
+	dir     string
+	modules map[string]*kernelModule
+	aliases []moduleAlias
+}
+
+// moduleName returns the name of the module at p; like kmod dashes and
+// underscores are treated the same
+func moduleName(p string) string {
+	name, _, _ := strings.Cut(path.Base(p), ".ko")
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// readModuleFile calls fn for every line of the file name in the module
+// directory which isn't empty or a comment
+func readModuleFile(dir, name string, fn func(line string) error) (err error) {
+	f, err := os.Open(path.Join(dir, name))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", name, err)
+	}
+	defer func() {
+		if closeErr := f.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close %s: %w", name, closeErr))
+		}
+	}()
+
+	return scanModuleFile(f, name, fn)
+}
+
+func scanModuleFile(r io.Reader, name string, fn func(line string) error) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return fmt.Errorf("failed to parse %s line %q: %w", name, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return nil
+}
+
+// loadModuleDB parses modules.dep, modules.builtin and modules.alias in the
+// module directory dir. Only modules.dep is required to exist.
+func loadModuleDB(dir string) (*moduleDB, error) {
+	db := &moduleDB{
+		dir:     dir,
+		modules: map[string]*kernelModule{},
+	}
+
+	// Paths in modules.dep are relative to the module directory, apart from
+	// very old versions of depmod which used absolute paths
+	modulePath := func(p string) string {
+		if path.IsAbs(p) {
+			return path.Join(dir, strings.TrimPrefix(p, path.Join("/lib/modules", path.Base(dir))))
+		}
+		return path.Join(dir, p)
+	}
+
+	err := readModuleFile(dir, "modules.dep", func(line string) error {
+		file, deps, ok := strings.Cut(line, ":")
+		if !ok {
+			return errors.New("missing colon")
+		}
+
+		mod := &kernelModule{name: moduleName(file), path: modulePath(file)}
+		for _, dep := range strings.Fields(deps) {
+			mod.depends = append(mod.depends, moduleName(dep))
+		}
+		db.modules[mod.name] = mod
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = readModuleFile(dir, "modules.builtin", func(line string) error {
+		name := moduleName(line)
+		db.modules[name] = &kernelModule{name: name}
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	err = readModuleFile(dir, "modules.alias", func(line string) error {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "alias" {
+			return errors.New("expected alias <pattern> <module>")
+		}
+		db.aliases = append(db.aliases, moduleAlias{fields[1], moduleName(fields[2])})
+		return nil
+	})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, mod := range db.modules {
+		for _, dep := range mod.depends {
+			if _, ok := db.modules[dep]; !ok {
+				return nil, fmt.Errorf("module %s depends on unknown module %s", mod.name, dep)
+			}
+		}
+	}
+
+	return db, nil
+}
+
+// lookup returns the module called name, which may also be an alias of the
+// module
+func (db *moduleDB) lookup(name string) (*kernelModule, error) {
+	if mod, ok := db.modules[moduleName(name)]; ok {
+		return mod, nil
+	}
+
+	for _, alias := range db.aliases {
+		if matched, _ := path.Match(alias.pattern, name); matched {
+			if mod, ok := db.modules[alias.name]; ok {
+				return mod, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("module %s not found in %s", name, db.dir)
+}
+
+// resolve returns the modules which need to be loaded for the modules called
+// names, including their dependencies, each following the module first
+// needing it. Modules built into the kernel are left out.
+func (db *moduleDB) resolve(names []string) ([]*kernelModule, error) {
+	var modules []*kernelModule
+	seen := map[string]bool{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		mod, err := db.lookup(name)
+		if err != nil {
+			return fmt.Errorf("kernel module %q not found: %w", name, err)
+		}
+		if mod.builtin() || seen[mod.name] {
+			return nil
+		}
+
+		seen[mod.name] = true
+		modules = append(modules, mod)
+		for _, dep := range mod.depends {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return modules, nil
+}
@@ -0,0 +1,96 @@
+package fakemachine
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func writeModuleFiles(t *testing.T, files map[string]string) string {
+	dir := path.Join(t.TempDir(), "6.1.0-9-amd64")
+	require.NoError(t, os.Mkdir(dir, 0755))
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(path.Join(dir, name), []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestModuleDB(t *testing.T) {
+	dir := writeModuleFiles(t, map[string]string{
+		"modules.dep": `kernel/net/9p/9pnet.ko.xz:
+kernel/net/9p/9pnet_virtio.ko.xz: kernel/net/9p/9pnet.ko.xz
+kernel/fs/netfs/netfs.ko.xz:
+kernel/fs/9p/9p.ko.xz: kernel/net/9p/9pnet.ko.xz kernel/fs/netfs/netfs.ko.xz
+kernel/drivers/md/dm-crypt.ko.zst:
+`,
+		"modules.builtin": `kernel/drivers/virtio/virtio_pci.ko
+`,
+		"modules.alias": `# Aliases extracted from modules themselves.
+alias fs-9p 9p
+alias dm-crypt* dm-crypt
+`,
+	})
+
+	db, err := loadModuleDB(dir)
+	require.NoError(t, err)
+
+	mod, err := db.lookup("9p")
+	require.NoError(t, err)
+	require.Equal(t, path.Join(dir, "kernel/fs/9p/9p.ko.xz"), mod.path)
+	require.Equal(t, []string{"9pnet", "netfs"}, mod.depends)
+	require.False(t, mod.builtin())
+
+	mod, err = db.lookup("virtio-pci")
+	require.NoError(t, err)
+	require.True(t, mod.builtin())
+
+	mod, err = db.lookup("fs-9p")
+	require.NoError(t, err)
+	require.Equal(t, "9p", mod.name)
+
+	mod, err = db.lookup("dm-crypt-aes")
+	require.NoError(t, err)
+	require.Equal(t, "dm_crypt", mod.name)
+
+	_, err = db.lookup("btrfs")
+	require.Error(t, err)
+}
+
+func TestModuleDBUnknownDependency(t *testing.T) {
+	dir := writeModuleFiles(t, map[string]string{
+		"modules.dep": `kernel/fs/9p/9p.ko: kernel/net/9p/9pnet.ko
+`,
+	})
+
+	_, err := loadModuleDB(dir)
+	require.Error(t, err)
+}
+
+func TestModuleDBResolve(t *testing.T) {
+	dir := writeModuleFiles(t, map[string]string{
+		"modules.dep": `kernel/net/9p/9pnet.ko:
+kernel/net/9p/9pnet_virtio.ko: kernel/net/9p/9pnet.ko
+kernel/fs/netfs/netfs.ko:
+kernel/fs/9p/9p.ko: kernel/net/9p/9pnet.ko kernel/fs/netfs/netfs.ko
+`,
+		"modules.builtin": `kernel/drivers/virtio/virtio_pci.ko
+`,
+	})
+
+	db, err := loadModuleDB(dir)
+	require.NoError(t, err)
+
+	modules, err := db.resolve([]string{"virtio_pci", "9p", "9pnet_virtio", "netfs"})
+	require.NoError(t, err)
+
+	var names []string
+	for _, mod := range modules {
+		names = append(names, mod.name)
+	}
+	require.Equal(t, []string{"9p", "9pnet", "netfs", "9pnet_virtio"}, names)
+
+	_, err = db.resolve([]string{"btrfs"})
+	require.Error(t, err)
+}
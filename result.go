@@ -0,0 +1,141 @@
+//go:build linux && (arm64 || amd64 || riscv64 || arm || 386 || ppc64le)
+
+package fakemachine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// RunPhase is the phase of a run of the machine in which it failed
+type RunPhase string
+
+const (
+	// PhaseNone means the command ran to completion, whatever its exit code
+	PhaseNone RunPhase = ""
+	// PhaseSetup means preparing the machine on the host failed
+	PhaseSetup RunPhase = "setup"
+	// PhaseBackend means the backend failed to start or crashed
+	PhaseBackend RunPhase = "backend"
+	// PhaseBoot means the machine stopped before it started the command
+	PhaseBoot RunPhase = "boot"
+	// PhaseKernelPanic means the kernel of the machine panicked
+	PhaseKernelPanic RunPhase = "kernel-panic"
+	// PhaseNetwork means setting up the network in the machine failed
+	PhaseNetwork RunPhase = "network"
+	// PhaseFileVolume means mounting a file volume in the machine failed
+	PhaseFileVolume RunPhase = "file-volume"
+	// PhaseCommand means the machine stopped while the command was running
+	PhaseCommand RunPhase = "command"
+)
+
+// RunResult describes the outcome of running a command in the machine
+type RunResult struct {
+	// Backend is the name of the backend the machine ran on
+	Backend string
+	// ExitCode is the exit code of the command, or -1 if it didn't finish
+	ExitCode int
+	// Signal is the signal which killed the command, or 0 if it exited.
+	// Following the shell convention, exit codes above 128 are taken as
+	// being killed by signal ExitCode - 128.
+	Signal syscall.Signal
+	// OOMKilled is set if the out of memory killer killed any process of the
+	// command
+	OOMKilled bool
+	// FailedPhase is the phase the run failed in, PhaseNone if the command
+	// ran to completion
+	FailedPhase RunPhase
+	// BootDuration is the time from the kernel starting until the command
+	// started
+	BootDuration time.Duration
+	// RunDuration is the time the command ran for
+	RunDuration time.Duration
+}
+
+// The wrapper script records the progress of the command in the result file
+// as lines of "<key> <value>":
+//
+//	started <uptime>   the command is started
+//	finished <uptime>  the command finished
+//	exit <code>        exit code of the command
+//	oom_kill <count>   processes killed by the OOM killer
+//	failed <phase>     the machine failed before starting the command
+func parseRunResult(data []byte, result *RunResult) error {
+	var started, finished time.Duration
+	var hasStarted, hasExit bool
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		key, value, _ := strings.Cut(line, " ")
+		var err error
+		switch key {
+		case "started":
+			started, err = parseUptime(value)
+			hasStarted = true
+		case "finished":
+			finished, err = parseUptime(value)
+		case "exit":
+			result.ExitCode, err = strconv.Atoi(value)
+			hasExit = true
+		case "oom_kill":
+			// Empty if memory accounting isn't available
+			if value != "" {
+				var count int
+				count, err = strconv.Atoi(value)
+				result.OOMKilled = count > 0
+			}
+		case "failed":
+			result.FailedPhase = RunPhase(value)
+		default:
+			err = fmt.Errorf("unknown key %q", key)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to parse result line %q: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to scan result: %w", err)
+	}
+
+	if hasStarted {
+		result.BootDuration = started
+	}
+	if hasExit {
+		if finished > started {
+			result.RunDuration = finished - started
+		}
+		if result.ExitCode > 128 && result.ExitCode <= 128+64 {
+			result.Signal = syscall.Signal(result.ExitCode - 128)
+		}
+	} else {
+		result.ExitCode = -1
+		if result.FailedPhase == PhaseNone {
+			if hasStarted {
+				result.FailedPhase = PhaseCommand
+			} else {
+				result.FailedPhase = PhaseBoot
+			}
+		}
+	}
+
+	return nil
+}
+
+// parseUptime parses the seconds since boot as reported by /proc/uptime
+func parseUptime(uptime string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(uptime, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse uptime: %w", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
@@ -0,0 +1,86 @@
+package fakemachine
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRunResult(t *testing.T) {
+	cases := []struct {
+		name   string
+		data   string
+		result RunResult
+	}{
+		{
+			name: "success",
+			data: "started 3.50\nfinished 5.75\noom_kill 0\nexit 0\n",
+			result: RunResult{ExitCode: 0, BootDuration: 3500 * time.Millisecond,
+				RunDuration: 2250 * time.Millisecond},
+		},
+		{
+			name: "signal",
+			data: "started 1.00\nfinished 2.00\noom_kill 1\nexit 137\n",
+			result: RunResult{ExitCode: 137, Signal: syscall.SIGKILL, OOMKilled: true,
+				BootDuration: time.Second, RunDuration: time.Second},
+		},
+		{
+			name: "no memory accounting",
+			data: "started 1.00\nfinished 2.00\noom_kill \nexit 3\n",
+			result: RunResult{ExitCode: 3, BootDuration: time.Second,
+				RunDuration: time.Second},
+		},
+		{
+			name:   "network",
+			data:   "failed network\n",
+			result: RunResult{ExitCode: -1, FailedPhase: PhaseNetwork},
+		},
+		{
+			name:   "file volume",
+			data:   "failed file-volume\n",
+			result: RunResult{ExitCode: -1, FailedPhase: PhaseFileVolume},
+		},
+		{
+			name:   "boot",
+			data:   "",
+			result: RunResult{ExitCode: -1, FailedPhase: PhaseBoot},
+		},
+		{
+			name: "command",
+			data: "started 1.00\n",
+			result: RunResult{ExitCode: -1, FailedPhase: PhaseCommand,
+				BootDuration: time.Second},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var result RunResult
+			require.NoError(t, parseRunResult([]byte(c.data), &result))
+			require.Equal(t, c.result, result)
+		})
+	}
+
+	var result RunResult
+	require.Error(t, parseRunResult([]byte("exit foo\n"), &result))
+	require.Error(t, parseRunResult([]byte("unknown 1\n"), &result))
+}
+
+func TestRunWithResult(t *testing.T) {
+	m := CreateMachine(t)
+
+	result, err := m.RunWithResult("exit 3")
+	require.NoError(t, err)
+	require.Equal(t, 3, result.ExitCode)
+	require.Equal(t, PhaseNone, result.FailedPhase)
+	require.Equal(t, m.backend.Name(), result.Backend)
+	require.NotZero(t, result.BootDuration)
+
+	m = CreateMachine(t)
+
+	result, err = m.RunWithResult("sh -c 'kill -KILL $$'")
+	require.NoError(t, err)
+	require.Equal(t, syscall.SIGKILL, result.Signal)
+}
@@ -0,0 +1,366 @@
+//go:build linux && (arm64 || amd64 || riscv64 || arm || 386 || ppc64le)
+
+package fakemachine
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Directory the session directory is mounted at inside the machine
+const sessionMachineDirectory = "/run/fakemachine-session"
+
+// The session agent runs as the command of the machine. It reads requests of
+// the form "<operation> <id> <argument>" from the agent device and answers
+// each with "done <id> <exitcode>". Commands to execute and files to copy are
+// exchanged via the session directory. The machine powers off once the agent
+// is asked to shut down or the host side of the agent device is closed. The
+// agent device is closed for everything the agent runs, so commands can't
+// interfere with the requests or keep the device open.
+const sessionAgent = `udevadm settle
+exec 3<>%[1]s
+echo ready >&3
+while read -r op id arg <&3; do
+  case "$op" in
+  exec)
+    sh %[2]s/exec-$id.sh 3>&-
+    echo "done $id $?" >&3
+    ;;
+  copyin)
+    cp %[2]s/copy-$id "$arg" 3>&-
+    echo "done $id $?" >&3
+    ;;
+  copyout)
+    cp "$arg" %[2]s/copy-$id 3>&-
+    echo "done $id $?" >&3
+    ;;
+  shutdown)
+    break
+    ;;
+  esac
+done
+exec 3>&-
+true`
+
+// Session is a running machine which executes commands on request rather than
+// powering off after a single command, see Machine.Start.
+type Session struct {
+	machine *Machine
+	dir     string
+
+	listener *net.UnixListener
+	conn     *net.UnixConn
+	replies  chan string
+	cancel   context.CancelFunc
+
+	// Closed once the machine has exited, after which result and err hold
+	// the outcome of running the agent
+	done   chan struct{}
+	result RunResult
+	err    error
+
+	// Serialises requests to the agent
+	mu     sync.Mutex
+	nextID int
+}
+
+// Start boots the machine and returns a session to execute commands in it.
+// Unlike Run the machine keeps running until Shutdown is called, avoiding the
+// boot cost for every command. Shutdown has to be called even if the session
+// got terminated. Only one session can be running per machine at a time.
+func (m *Machine) Start() (_ *Session, err error) {
+	if m.agentSocket != "" {
+		return nil, errors.New("a session is already running for this machine")
+	}
+
+	dir, err := os.MkdirTemp("", "fakemachine-session-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session directory: %w", err)
+	}
+
+	s := &Session{
+		machine: m,
+		dir:     dir,
+		replies: make(chan string),
+		done:    make(chan struct{}),
+	}
+
+	socket := path.Join(dir, "agent.sock")
+	s.listener, err = net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return nil, errors.Join(fmt.Errorf("failed to listen on %s: %w", socket, err), s.cleanup())
+	}
+
+	m.agentSocket = socket
+	m.AddVolumeAt(dir, sessionMachineDirectory)
+
+	if !m.quiet {
+		fmt.Printf("Starting session using %s backend\n", m.backend.Name())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	agent := fmt.Sprintf(sessionAgent, m.backend.AgentDevice(), sessionMachineDirectory)
+	go func() {
+		s.result, s.err = m.startup(ctx, agent, nil)
+		close(s.done)
+	}()
+
+	// Stop waiting for the agent if the machine exits before it connects
+	go func() {
+		<-s.done
+		_ = s.listener.Close()
+	}()
+
+	s.conn, err = s.listener.AcceptUnix()
+	if err != nil {
+		<-s.done
+		if s.err == nil {
+			s.err = fmt.Errorf("machine failed in %s phase before the session agent started", s.result.FailedPhase)
+		}
+		return nil, errors.Join(s.err, s.cleanup())
+	}
+
+	go s.readReplies()
+
+	if reply, ok := <-s.replies; !ok || reply != "ready" {
+		return nil, errors.Join(s.terminate(), s.cleanup(),
+			fmt.Errorf("session agent failed to start: unexpected reply %q", reply))
+	}
+
+	return s, nil
+}
+
+// readReplies passes the lines sent by the agent to the replies channel until
+// the agent device is closed
+func (s *Session) readReplies() {
+	defer close(s.replies)
+
+	r := bufio.NewReader(s.conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		s.replies <- strings.TrimSpace(line)
+	}
+}
+
+// request sends a request to the agent and waits for its answer, returning
+// the exit code of the operation in the machine. If ctx is cancelled while
+// waiting the session is terminated.
+func (s *Session) request(ctx context.Context, op string, id int, arg string) (int, error) {
+	if strings.ContainsAny(arg, "\n") {
+		return -1, fmt.Errorf("invalid argument %q: contains a newline", arg)
+	}
+
+	if _, err := fmt.Fprintf(s.conn, "%s %d %s\n", op, id, arg); err != nil {
+		return -1, fmt.Errorf("failed to send %s request to session agent: %w", op, err)
+	}
+
+	select {
+	case reply, ok := <-s.replies:
+		if !ok {
+			<-s.done
+			return -1, errors.Join(s.err, fmt.Errorf("machine exited during %s request", op))
+		}
+
+		var replyID, exitcode int
+		if _, err := fmt.Sscanf(reply, "done %d %d", &replyID, &exitcode); err != nil || replyID != id {
+			return -1, fmt.Errorf("unexpected reply from session agent: %q", reply)
+		}
+		return exitcode, nil
+	case <-ctx.Done():
+		return -1, errors.Join(&TerminatedError{Backend: s.machine.backend.Name(), Err: ctx.Err()}, s.terminate())
+	}
+}
+
+func (s *Session) newID() int {
+	s.nextID++
+	return s.nextID
+}
+
+// Exec runs command inside the machine and returns its exit code. The command
+// is run by sh with the same environment and streams as commands started by
+// Machine.Run. If ctx is cancelled before the command finishes the whole
+// session is terminated and a *TerminatedError is returned.
+func (s *Session) Exec(ctx context.Context, command string) (_ int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.newID()
+	script := path.Join(s.dir, fmt.Sprintf("exec-%d.sh", id))
+	if err := os.WriteFile(script, []byte(command+"\n"), 0755); err != nil {
+		return -1, fmt.Errorf("failed to write command script: %w", err)
+	}
+	defer func() {
+		if removeErr := os.Remove(script); removeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to remove command script: %w", removeErr))
+		}
+	}()
+
+	return s.request(ctx, "exec", id, "")
+}
+
+// CopyIn copies the regular file hostPath into the machine at machinePath
+func (s *Session) CopyIn(hostPath, machinePath string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.newID()
+	transfer := path.Join(s.dir, fmt.Sprintf("copy-%d", id))
+	if err := copyFile(hostPath, transfer); err != nil {
+		return err
+	}
+	defer func() {
+		if removeErr := os.Remove(transfer); removeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to remove transfer file: %w", removeErr))
+		}
+	}()
+
+	exitcode, err := s.request(context.Background(), "copyin", id, machinePath)
+	if err != nil {
+		return err
+	}
+	if exitcode != 0 {
+		return fmt.Errorf("failed to copy %s to %s inside machine: exit code %d", hostPath, machinePath, exitcode)
+	}
+	return nil
+}
+
+// CopyOut copies the regular file machinePath out of the machine to hostPath
+func (s *Session) CopyOut(machinePath, hostPath string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := s.newID()
+	transfer := path.Join(s.dir, fmt.Sprintf("copy-%d", id))
+	defer func() {
+		if removeErr := os.Remove(transfer); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+			err = errors.Join(err, fmt.Errorf("failed to remove transfer file: %w", removeErr))
+		}
+	}()
+
+	exitcode, err := s.request(context.Background(), "copyout", id, machinePath)
+	if err != nil {
+		return err
+	}
+	if exitcode != 0 {
+		return fmt.Errorf("failed to copy %s out of machine: exit code %d", machinePath, exitcode)
+	}
+
+	return copyFile(transfer, hostPath)
+}
+
+// Shutdown asks the agent to exit, waits for the machine to power off and
+// releases the resources of the session. It returns an error if the machine
+// failed at any point during the session.
+func (s *Session) Shutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+	default:
+		if _, err := fmt.Fprintf(s.conn, "shutdown 0\n"); err != nil {
+			return errors.Join(fmt.Errorf("failed to send shutdown request to session agent: %w", err),
+				s.terminate(), s.cleanup())
+		}
+		<-s.done
+	}
+
+	// Terminations have already been reported by the cancelled request
+	err := s.err
+	var terminatedErr *TerminatedError
+	if errors.As(err, &terminatedErr) {
+		return s.cleanup()
+	}
+	if err == nil && s.result.FailedPhase != PhaseNone {
+		err = fmt.Errorf("machine failed in %s phase", s.result.FailedPhase)
+	} else if err == nil && s.result.ExitCode != 0 {
+		err = fmt.Errorf("session agent exited with code %d", s.result.ExitCode)
+	}
+	return errors.Join(err, s.cleanup())
+}
+
+// terminate kills the machine and waits for it to exit
+func (s *Session) terminate() error {
+	s.cancel()
+	<-s.done
+
+	var terminatedErr *TerminatedError
+	if errors.As(s.err, &terminatedErr) {
+		return nil
+	}
+	return s.err
+}
+
+// cleanup detaches the session from its machine and removes the session
+// directory
+func (s *Session) cleanup() error {
+	m := s.machine
+
+	if s.conn != nil {
+		_ = s.conn.Close()
+	}
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+
+	m.agentSocket = ""
+	for i, mount := range m.mounts {
+		if mount.hostDirectory == s.dir {
+			m.mounts = append(m.mounts[:i], m.mounts[i+1:]...)
+			break
+		}
+	}
+
+	if err := os.RemoveAll(s.dir); err != nil {
+		return fmt.Errorf("failed to remove session directory %s: %w", s.dir, err)
+	}
+	return nil
+}
+
+// copyFile copies the regular file src to dst, preserving its permissions
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer func() {
+		if closeErr := in.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close %s: %w", src, closeErr))
+		}
+	}()
+
+	info, err := in.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", src, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("failed to copy %s: not a regular file", src)
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dst, err)
+	}
+	defer func() {
+		if closeErr := out.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to close %s: %w", dst, closeErr))
+		}
+	}()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
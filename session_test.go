@@ -0,0 +1,65 @@
+package fakemachine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSession(t *testing.T) {
+	m := CreateMachine(t)
+
+	s, err := m.Start()
+	require.NoError(t, err)
+
+	exitcode, err := s.Exec(context.Background(), "true")
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+
+	exitcode, err = s.Exec(context.Background(), "exit 3")
+	require.NoError(t, err)
+	require.Equal(t, 3, exitcode)
+
+	// Commands don't inherit the agent device
+	exitcode, err = s.Exec(context.Background(), "test ! -e /proc/self/fd/3")
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+
+	dir := t.TempDir()
+	in := filepath.Join(dir, "in")
+	require.NoError(t, os.WriteFile(in, []byte("some content"), 0644))
+	require.NoError(t, s.CopyIn(in, "/scratch/file"))
+
+	exitcode, err = s.Exec(context.Background(), "test \"$(cat /scratch/file)\" = 'some content'")
+	require.NoError(t, err)
+	require.Equal(t, 0, exitcode)
+
+	out := filepath.Join(dir, "out")
+	require.NoError(t, s.CopyOut("/scratch/file", out))
+	content, err := os.ReadFile(out)
+	require.NoError(t, err)
+	require.Equal(t, "some content", string(content))
+
+	require.Error(t, s.CopyOut("/does/not/exist", out))
+
+	require.NoError(t, s.Shutdown())
+}
+
+func TestSessionCancelledExec(t *testing.T) {
+	m := CreateMachine(t)
+
+	s, err := m.Start()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	exitcode, err := s.Exec(ctx, "sleep 3600")
+	require.Equal(t, -1, exitcode)
+	require.ErrorIs(t, err, context.Canceled)
+
+	require.NoError(t, s.Shutdown())
+}